@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"pal/palvm"
+	"palsm/palexer"
+	palsm "palsm/palsm_h"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const debugHelp = `Commands:
+  step [n]               execute the next n instructions (default 1)
+  next                   execute the next instruction, running a CALL until it returns
+  continue               run until a breakpoint, HALT or fault
+  break [addr|label]     set a breakpoint, or list them with no argument
+  delete <addr|label>    remove a breakpoint
+  regs                   print R1-R9 and the flag
+  stack                  dump the current frame, from bp up to sp
+  mem <addr|label> [n]   print n words of data memory (default 8)
+  disasm [n]             disassemble n instructions either side of the current one (default 4)
+  reset                  restart the program
+  quit                   leave the debugger
+An empty line repeats the previous command.`
+
+// Debugger drives a VM one instruction at a time from commands typed at a prompt
+type Debugger struct {
+	vm          *palvm.VM
+	out         io.Writer
+	labels      map[string]int   // Map of code labels to their index
+	dataLabels  map[string]int   // Map of data labels to their address
+	indexLabels map[int][]string // Map of indexes to the code labels on them
+	breakpoints map[int]bool
+	debug       []palsm.DebugLine // Source lines of the image, empty if it was stripped
+	finished    bool              // Set once the program halts or faults
+}
+
+// Debug runs the interactive debugger on vm, reading commands from in until quit or end of input
+func Debug(vm *palvm.VM, image palsm.Image, in io.Reader) {
+	debugger := Debugger{
+		vm:          vm,
+		out:         os.Stdout,
+		labels:      make(map[string]int),
+		dataLabels:  make(map[string]int),
+		indexLabels: make(map[int][]string),
+		breakpoints: make(map[int]bool),
+		debug:       image.Debug,
+	}
+	for _, symbol := range image.Symbols {
+		if symbol.Section == palsm.SECTION_DATA {
+			debugger.dataLabels[symbol.Name] = int(symbol.Value)
+		} else {
+			debugger.labels[symbol.Name] = int(symbol.Value)
+			debugger.indexLabels[int(symbol.Value)] = append(debugger.indexLabels[int(symbol.Value)], symbol.Name)
+		}
+	}
+
+	fmt.Fprintln(debugger.out, "PAL debugger, type 'help' for a list of commands.")
+	debugger.PrintCurrent()
+
+	scanner := bufio.NewScanner(in)
+	last := ""
+	for {
+		fmt.Fprint(debugger.out, "(pal) ")
+		if !scanner.Scan() {
+			fmt.Fprintln(debugger.out)
+			return
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			line = last
+		}
+		last = line
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if !debugger.Execute(fields[0], fields[1:]) {
+			return
+		}
+	}
+}
+
+// Execute a single debugger command, returning false when the debugger should exit
+func (debugger *Debugger) Execute(command string, args []string) bool {
+	switch command {
+	case "step", "s":
+		count := 1
+		if len(args) > 0 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 1 {
+				fmt.Fprintf(debugger.out, "Invalid count '%s'.\n", args[0])
+				return true
+			}
+			count = n
+		}
+		for i := 0; i < count && debugger.Step(); i++ {
+		}
+		debugger.PrintCurrent()
+	case "next", "n":
+		depth := debugger.vm.CallDepth()
+		if debugger.Step() {
+			for debugger.vm.CallDepth() > depth && !debugger.breakpoints[debugger.vm.PC()] && debugger.Step() {
+			}
+		}
+		debugger.PrintCurrent()
+	case "continue", "c":
+		if debugger.Step() {
+			for !debugger.breakpoints[debugger.vm.PC()] && debugger.Step() {
+			}
+		}
+		if !debugger.finished {
+			fmt.Fprintf(debugger.out, "Breakpoint at 0x%04X\n", debugger.vm.PC())
+		}
+		debugger.PrintCurrent()
+	case "break", "b":
+		if len(args) == 0 {
+			debugger.PrintBreakpoints()
+			return true
+		}
+		if index, ok := debugger.ParseBreakpoint(args[0]); ok {
+			debugger.breakpoints[index] = true
+			fmt.Fprintf(debugger.out, "Breakpoint set at 0x%04X\n", index)
+		}
+	case "delete":
+		if len(args) == 0 {
+			fmt.Fprintln(debugger.out, "Usage: delete <addr|label>")
+			return true
+		}
+		if index, ok := debugger.ParseBreakpoint(args[0]); ok {
+			delete(debugger.breakpoints, index)
+		}
+	case "regs", "r":
+		debugger.PrintRegisters()
+	case "stack":
+		debugger.PrintStack()
+	case "mem", "m":
+		if len(args) == 0 {
+			fmt.Fprintln(debugger.out, "Usage: mem <addr|label> [n]")
+			return true
+		}
+		address, ok := debugger.ParseAddress(args[0], debugger.dataLabels)
+		if !ok {
+			return true
+		}
+		count := 8
+		if len(args) > 1 {
+			if n, err := strconv.Atoi(args[1]); err == nil && n > 0 {
+				count = n
+			}
+		}
+		debugger.PrintMemory(address, count)
+	case "disasm", "dis":
+		around := 4
+		if len(args) > 0 {
+			if n, err := strconv.Atoi(args[0]); err == nil && n >= 0 {
+				around = n
+			}
+		}
+		debugger.PrintDisassembly(around)
+	case "reset":
+		debugger.vm.Reset()
+		debugger.finished = false
+		debugger.PrintCurrent()
+	case "help", "h":
+		fmt.Fprintln(debugger.out, debugHelp)
+	case "quit", "q":
+		return false
+	default:
+		fmt.Fprintf(debugger.out, "Unknown command '%s', type 'help' for a list of commands.\n", command)
+	}
+	return true
+}
+
+// Step executes a single instruction, returning false once the program can no longer run
+func (debugger *Debugger) Step() bool {
+	if debugger.finished {
+		fmt.Fprintln(debugger.out, "The program is not running, use 'reset' to start it again.")
+		return false
+	}
+	running, err := debugger.vm.Step()
+	if errors.Is(err, palvm.ErrStepLimit) {
+		fmt.Fprintf(debugger.out, "\nStopped: %s\n", err.Error())
+	} else if err != nil {
+		fmt.Fprintf(debugger.out, "\nFault: %s\n", err.Error())
+	} else if !running {
+		fmt.Fprintf(debugger.out, "\n[0x%X] Halt\n", debugger.vm.Result().IP)
+	}
+	debugger.finished = !running
+	return running
+}
+
+// Read an address as a decimal or 0x prefixed number, or a label from labels
+func (debugger *Debugger) ParseAddress(arg string, labels map[string]int) (int, bool) {
+	if index, ok := labels[arg]; ok {
+		return index, true
+	}
+	index, err := strconv.ParseInt(arg, 0, 64)
+	if err != nil || index < 0 {
+		fmt.Fprintf(debugger.out, "'%s' is not an address or a known label.\n", arg)
+		return 0, false
+	}
+	return int(index), true
+}
+
+// Read a breakpoint address, which has to be the start of an instruction in the program
+func (debugger *Debugger) ParseBreakpoint(arg string) (int, bool) {
+	index, ok := debugger.ParseAddress(arg, debugger.labels)
+	if !ok {
+		return 0, false
+	}
+	program := debugger.vm.Program()
+	if index >= len(program) {
+		fmt.Fprintf(debugger.out, "Address 0x%04X is outside the program.\n", index)
+		return 0, false
+	}
+	starts := palexer.InstructionStarts(program)
+	if i := sort.SearchInts(starts, index); i == len(starts) || starts[i] != index {
+		fmt.Fprintf(debugger.out, "Address 0x%04X is not the start of an instruction.\n", index)
+		return 0, false
+	}
+	return index, true
+}
+
+// Print the instruction about to be executed
+func (debugger *Debugger) PrintCurrent() {
+	if debugger.finished {
+		return
+	}
+	starts := palexer.InstructionStarts(debugger.vm.Program())
+	for _, start := range starts {
+		if start == debugger.vm.PC() {
+			debugger.PrintInstruction(start)
+			return
+		}
+	}
+	fmt.Fprintf(debugger.out, "=> 0x%04X: <end of program>\n", debugger.vm.PC())
+}
+
+// Print the instruction starting at index, marking it if it is the current one
+func (debugger *Debugger) PrintInstruction(index int) {
+	program := debugger.vm.Program()
+	if index < 0 || index >= len(program) {
+		fmt.Fprintf(debugger.out, "   0x%04X: <outside the program>\n", index)
+		return
+	}
+	for _, label := range debugger.indexLabels[index] {
+		fmt.Fprintf(debugger.out, "%s:\n", label)
+	}
+	end, _ := palexer.InstructionEnd(program, index)
+	marker := "  "
+	if index == debugger.vm.PC() {
+		marker = "=>"
+	}
+	breakpoint := " "
+	if debugger.breakpoints[index] {
+		breakpoint = "*"
+	}
+	text := palexer.FormatInstruction(program[index : end+1])
+	if palexer.IsLabelCommand(program[end]) && end > index { // Show the label being jumped to rather than its index
+		if labels := debugger.indexLabels[int(program[index])]; len(labels) > 0 && program[index]>>30 == 0 {
+			text = palexer.FormatWord(program[end]) + " " + labels[0]
+		}
+	}
+	if source, ok := palsm.FindDebugLine(debugger.debug, index); ok {
+		text = fmt.Sprintf("%-24s ; %s", text, source)
+	}
+	fmt.Fprintf(debugger.out, "%s%s0x%04X: %s\n", marker, breakpoint, index, text)
+}
+
+// Print the instructions either side of the current one
+func (debugger *Debugger) PrintDisassembly(around int) {
+	starts := palexer.InstructionStarts(debugger.vm.Program())
+	current := sort.SearchInts(starts, debugger.vm.PC())
+	from, to := current-around, current+around
+	if from < 0 {
+		from = 0
+	}
+	if to >= len(starts) {
+		to = len(starts) - 1
+	}
+	for i := from; i <= to; i++ {
+		debugger.PrintInstruction(starts[i])
+	}
+}
+
+func (debugger *Debugger) PrintRegisters() {
+	for i, value := range debugger.vm.MemRegisters {
+		fmt.Fprintf(debugger.out, "R%d = %-12d", i+1, value)
+		if i%3 == 2 {
+			fmt.Fprintln(debugger.out)
+		}
+	}
+	fmt.Fprintf(debugger.out, "Flag = %t\n", debugger.vm.FlagRegister)
+}
+
+func (debugger *Debugger) PrintStack() {
+	bp, sp, frame := debugger.vm.StackFrame()
+	fmt.Fprintf(debugger.out, "bp = %d, sp = %d\n", bp, sp)
+	for i := len(frame) - 1; i >= 0; i-- {
+		fmt.Fprintf(debugger.out, "  [%d] %d\n", int(bp)+i, frame[i])
+	}
+}
+
+func (debugger *Debugger) PrintMemory(address int, count int) {
+	memory := debugger.vm.Memory
+	for i := address; i < address+count; i++ {
+		if i >= len(memory) {
+			fmt.Fprintf(debugger.out, "Address 0x%04X is outside data memory.\n", i)
+			return
+		}
+		fmt.Fprintf(debugger.out, "  0x%04X: %d\n", i, memory[i])
+	}
+}
+
+func (debugger *Debugger) PrintBreakpoints() {
+	if len(debugger.breakpoints) == 0 {
+		fmt.Fprintln(debugger.out, "No breakpoints.")
+		return
+	}
+	indexes := make([]int, 0, len(debugger.breakpoints))
+	for index := range debugger.breakpoints {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		debugger.PrintInstruction(index)
+	}
+}
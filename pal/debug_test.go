@@ -0,0 +1,40 @@
+package main
+
+import (
+	"pal/palvm"
+	"palsm/palexer"
+	"strings"
+	"testing"
+)
+
+func TestBreakpointAddresses(t *testing.T) {
+	program, diagnostics, err := palexer.Assemble("MOV R1 1\nADD R1 2")
+	if err != nil {
+		t.Fatalf("assembling: %v", diagnostics)
+	}
+	var out strings.Builder
+	debugger := Debugger{
+		vm:          palvm.New(program.Code),
+		out:         &out,
+		breakpoints: make(map[int]bool),
+	}
+	for _, command := range []string{"0x1000", "1", "3"} {
+		debugger.Execute("break", []string{command})
+	}
+	debugger.Execute("delete", []string{"0x1000"})
+	debugger.Execute("break", nil) // Used to panic listing a breakpoint past the end of the program
+
+	if len(debugger.breakpoints) != 1 || !debugger.breakpoints[3] {
+		t.Errorf("unexpected breakpoints %v", debugger.breakpoints)
+	}
+	for _, message := range []string{"0x1000 is outside the program", "0x0001 is not the start of an instruction", "Breakpoint set at 0x0003"} {
+		if !strings.Contains(out.String(), message) {
+			t.Errorf("missing %q in:\n%s", message, out.String())
+		}
+	}
+
+	debugger.PrintInstruction(0x1000)
+	if !strings.Contains(out.String(), "<outside the program>") {
+		t.Errorf("missing <outside the program> in:\n%s", out.String())
+	}
+}
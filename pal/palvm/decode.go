@@ -0,0 +1,133 @@
+package palvm
+
+import (
+	"fmt"
+	palsm "palsm/palsm_h"
+)
+
+type OperandKind int
+
+const (
+	IMMEDIATE OperandKind = 0
+	REGISTER  OperandKind = 1
+	INDIRECT  OperandKind = 2
+)
+
+// Operand is a single decoded parameter of an instruction
+type Operand struct {
+	Kind   OperandKind
+	Value  int32 // The int of an IMMEDIATE, the register index of a REGISTER or INDIRECT
+	Offset int32 // Added to the register of an INDIRECT
+}
+
+// String gives the operand the way it would be written in a .palsm file
+func (operand Operand) String() string {
+	switch operand.Kind {
+	case REGISTER:
+		return fmt.Sprintf("R%d", operand.Value+1)
+	case INDIRECT:
+		if operand.Offset == 0 {
+			return fmt.Sprintf("[R%d]", operand.Value+1)
+		}
+		return fmt.Sprintf("[R%d%+d]", operand.Value+1, operand.Offset)
+	}
+	return fmt.Sprintf("%d", operand.Value)
+}
+
+// Instruction is an op code along with the operands the lexer placed before it
+type Instruction struct {
+	Addr   int    // Index of the first word of the instruction, the address labels and jumps use
+	Size   int    // Number of words, operands and op code
+	OpCode uint32 // Op code without its type bits
+	Word   uint32 // The op code word as it appears in the program
+	Args   []Operand
+}
+
+// Decode function
+/*
+	Read the instruction starting at addr. Each 32-bit word has its two most significant bits reserved to represent data as such:
+		0 -> positive int
+		1 -> OP_Code
+		2 -> negative int
+		3 -> register, or an indirect address when bit 29 is set
+	Operands are read until an op code is hit, which ends the instruction. An int too big for 30 bits is
+	a WideImmediate word followed by the int as a raw word.
+	On an error the returned instruction's Word is the word that could not be decoded.
+*/
+func Decode(program []uint32, addr int) (Instruction, error) {
+	instruction := Instruction{Addr: addr}
+	if addr < 0 || addr >= len(program) {
+		return instruction, ErrJumpOutOfRange
+	}
+	for i := addr; i < len(program); i++ {
+		word := program[i]
+		data := word & 0x3FFFFFFF
+		switch word >> 30 {
+		case 0: // Positive int
+			instruction.Args = append(instruction.Args, Operand{Kind: IMMEDIATE, Value: int32(data)})
+		case 2: // Negative int, add back in the sign to the left-most bits (from 0xBFFFFFFF to 0xFFFFFFFF)
+			instruction.Args = append(instruction.Args, Operand{Kind: IMMEDIATE, Value: int32(data | 0xC0000000)})
+		case 3:
+			if data&0x20000000 != 0 { // Indirect address, bits 28 through 4 are a signed offset and 3 through 0 the register
+				operand := Operand{Kind: INDIRECT, Value: int32(data & 0xF), Offset: int32(data<<3) >> 7}
+				if operand.Value >= 9 {
+					instruction.Word = word
+					return instruction, ErrInvalidRegister
+				}
+				instruction.Args = append(instruction.Args, operand)
+			} else {
+				if data >= 9 {
+					instruction.Word = word
+					return instruction, ErrInvalidRegister
+				}
+				instruction.Args = append(instruction.Args, Operand{Kind: REGISTER, Value: int32(data)})
+			}
+		case 1:
+			if word == palsm.WideImmediate { // The next word is the operand as a raw int32
+				if i+1 >= len(program) {
+					break // Missing its raw word, and so the op code too
+				}
+				i++
+				instruction.Args = append(instruction.Args, Operand{Kind: IMMEDIATE, Value: int32(program[i])})
+				continue
+			}
+			// Op code, the end of the instruction
+			instruction.Word = word
+			instruction.OpCode = data
+			instruction.Size = i - addr + 1
+			if int(data) >= len(palsm.Commands) {
+				return instruction, ErrUnknownOpCode
+			}
+			if len(instruction.Args) != palsm.Commands[data].NumParams {
+				return instruction, ErrOperandCount
+			}
+			return instruction, nil
+		}
+	}
+	instruction.Word = program[len(program)-1]
+	return instruction, ErrMissingOpCode
+}
+
+// DecodeProgram function
+/*
+	Decode the program ahead of time, from the first word until the end or the first word that cannot be decoded.
+	Returns the instructions along with a table mapping each address to the index of the instruction starting there,
+	or -1 for addresses that are not the start of a decoded instruction.
+*/
+func DecodeProgram(program []uint32) ([]Instruction, []int) {
+	instructions := []Instruction{}
+	indexes := make([]int, len(program))
+	for i := range indexes {
+		indexes[i] = -1
+	}
+	for addr := 0; addr < len(program); {
+		instruction, err := Decode(program, addr)
+		if err != nil {
+			break
+		}
+		indexes[addr] = len(instructions)
+		instructions = append(instructions, instruction)
+		addr += instruction.Size
+	}
+	return instructions, indexes
+}
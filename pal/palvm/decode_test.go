@@ -0,0 +1,52 @@
+package palvm
+
+import (
+	"io"
+	"palsm/palexer"
+	"testing"
+)
+
+// A loop in the style of add.palsm, run long enough for the dispatch loop to dominate
+const benchmarkLoop = `
+    MOV R1 0
+    MOV R2 0
+loop:
+    GTE R1 10000
+    JMPF done
+    ADD R1 1
+    ADD R2 R1
+    MUL R3 R1
+    PUSH R2
+    POP R4
+    JMP loop
+done:
+    HALT
+`
+
+func benchmarkRun(b *testing.B, predecoded bool) {
+	program, diagnostics, err := palexer.Assemble(benchmarkLoop)
+	if err != nil {
+		b.Fatalf("assembling: %v", diagnostics)
+	}
+	vm := New(program.Code, WithOutput(io.Discard))
+	if !predecoded { // Every Fetch falls back to Decode, as the interpreter did before the program was decoded up front
+		for i := range vm.indexes {
+			vm.indexes[i] = -1
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vm.Reset()
+		if _, err := vm.Run(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRunPredecoded(b *testing.B) {
+	benchmarkRun(b, true)
+}
+
+func BenchmarkRunDecodeEveryStep(b *testing.B) {
+	benchmarkRun(b, false)
+}
@@ -0,0 +1,84 @@
+package palvm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Runtime faults, use errors.Is against a returned error to find out which one stopped the machine
+var (
+	ErrStackOverflow    = errors.New("stack overflow")
+	ErrStackUnderflow   = errors.New("stack underflow")
+	ErrDivideByZero     = errors.New("division by zero")
+	ErrOverflow         = errors.New("integer overflow")
+	ErrInvalidRegister  = errors.New("invalid register")
+	ErrUnknownOpCode    = errors.New("unknown op code")
+	ErrJumpOutOfRange   = errors.New("jump out of range")
+	ErrEmptyCallStack   = errors.New("return with an empty call stack")
+	ErrMemoryOutOfRange = errors.New("memory address out of range")
+	ErrOperandCount     = errors.New("wrong number of operands")
+	ErrMissingOpCode    = errors.New("operands with no op code")
+	ErrBadInput         = errors.New("input is not an integer")
+)
+
+// Returned when the machine is stopped by one of its limits rather than the program, see WithMaxSteps and WithTimeout
+var (
+	ErrStepLimit = errors.New("step limit exceeded")
+	ErrTimeout   = errors.New("timeout exceeded")
+)
+
+// Fault is returned when the machine stops on a runtime error instead of a HALT
+type Fault struct {
+	Err    error  // One of the Err* values above
+	IP     int    // Address of the faulting instruction
+	Word   uint32 // The op code word being executed, or the word that could not be decoded
+	Source string // Source line of the instruction, when the image has debug lines
+}
+
+func (fault *Fault) Error() string {
+	text := fmt.Sprintf("[0x%X] %s (instruction 0x%08X)", fault.IP, fault.Err.Error(), fault.Word)
+	if fault.Source != "" {
+		text += " at " + fault.Source
+	}
+	return text
+}
+
+func (fault *Fault) Unwrap() error {
+	return fault.Err
+}
+
+type StopReason int
+
+// Why the machine stopped
+const (
+	RUNNING    StopReason = 0 // Not stopped yet
+	HALTED     StopReason = 1 // Executed a HALT
+	END        StopReason = 2 // Ran off the end of the program
+	FAULTED    StopReason = 3
+	STEP_LIMIT StopReason = 4
+	TIMEOUT    StopReason = 5
+)
+
+func (reason StopReason) String() string {
+	switch reason {
+	case HALTED:
+		return "halted"
+	case END:
+		return "end of program"
+	case FAULTED:
+		return "fault"
+	case STEP_LIMIT:
+		return ErrStepLimit.Error()
+	case TIMEOUT:
+		return ErrTimeout.Error()
+	}
+	return "running"
+}
+
+// Result describes how a program finished running
+type Result struct {
+	ExitStatus int // 0 when the program reached HALT, 1 when it faulted, 2 when it was stopped by a limit
+	IP         int // Program counter the machine stopped at
+	Steps      int // Number of op codes executed
+	Stop       StopReason
+}
@@ -0,0 +1,799 @@
+package palvm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	palsm "palsm/palsm_h"
+	"strconv"
+	"time"
+)
+
+// Type definitions
+type MemStack struct {
+	sp    uint32
+	bp    uint32
+	stack []int32
+}
+
+func (stack *MemStack) push(val int32) error {
+	if int(stack.sp) >= len(stack.stack) {
+		return ErrStackOverflow
+	}
+	stack.stack[stack.sp] = val
+	stack.sp++
+	return nil
+}
+
+// Values below bp belong to the caller's frame, so popping past it is an underflow
+func (stack *MemStack) pop() (int32, error) {
+	if stack.sp <= stack.bp {
+		return 0, ErrStackUnderflow
+	}
+	stack.sp--
+	val := stack.stack[stack.sp]
+	return val, nil
+}
+
+func (stack *MemStack) peek() int32 {
+	if stack.sp == stack.bp {
+		return 0
+	}
+	return stack.stack[stack.sp-1]
+}
+
+type ArithmeticOperation int
+type BooleanOperation int
+
+// Constants
+const (
+	ADD  ArithmeticOperation = 0
+	SUB  ArithmeticOperation = 1
+	MUL  ArithmeticOperation = 2
+	DIV  ArithmeticOperation = 3
+	MOD  ArithmeticOperation = 4
+	BAND ArithmeticOperation = 5
+	BOR  ArithmeticOperation = 6
+	BXOR ArithmeticOperation = 7
+	BNOT ArithmeticOperation = 8
+	SHL  ArithmeticOperation = 9
+	SHR  ArithmeticOperation = 10
+	SAR  ArithmeticOperation = 11
+	AND  BooleanOperation    = 0
+	OR   BooleanOperation    = 1
+	EQ   BooleanOperation    = 2
+	NEQ  BooleanOperation    = 3
+	GT   BooleanOperation    = 4
+	LT   BooleanOperation    = 5
+	GTE  BooleanOperation    = 6
+	LTE  BooleanOperation    = 7
+)
+
+type OverflowPolicy int
+
+// What ADD, SUB, MUL and DIV do when a result does not fit in an int32
+const (
+	WRAP     OverflowPolicy = 0 // Keep the low 32 bits, two's complement wrap around
+	TRAP     OverflowPolicy = 1 // Fault with ErrOverflow
+	SATURATE OverflowPolicy = 2 // Clamp to math.MinInt32 or math.MaxInt32
+)
+
+var overflowPolicyNames = []string{"wrap", "trap", "saturate"}
+
+func (policy OverflowPolicy) String() string {
+	if int(policy) < len(overflowPolicyNames) {
+		return overflowPolicyNames[policy]
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(policy))
+}
+
+// ParseOverflowPolicy turns wrap, trap or saturate into its OverflowPolicy
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	for i, policyName := range overflowPolicyNames {
+		if name == policyName {
+			return OverflowPolicy(i), nil
+		}
+	}
+	return WRAP, fmt.Errorf("unknown overflow policy '%s', expected wrap, trap or saturate", name)
+}
+
+const DefaultStackSize = 1000000
+const DefaultMemorySize = 65536
+const timeoutCheckSteps = 1024
+
+// Initialize MemStack
+func InitMemStack(pointer uint32, size uint64) MemStack {
+	memStack := MemStack{bp: pointer, sp: pointer, stack: make([]int32, size)}
+	return memStack
+}
+
+// VM holds the full state of a single PAL machine, so several programs can run side by side in one process.
+type VM struct {
+	MemRegisters [9]int32 // Registers R1-R9
+	FlagRegister bool
+	MemStack     MemStack
+	Memory       []int32 // Data memory, addressed by LOAD and STORE
+
+	program      []uint32
+	instructions []Instruction // The program decoded when the machine was created
+	indexes      []int         // Map of addresses to the index of the decoded instruction starting there, or -1
+	pc           int           // Program counter, the address of the first word of the next instruction
+	stackSize    uint64
+	memSize      uint64
+	data         []int32 // Initial contents of data memory
+	entry        int     // Address of the first instruction to execute
+	halted       bool
+	fault        error
+	steps        int
+	callDepth    int // Number of CALLs still waiting on a RET
+	tracer       Tracer
+	maxSteps     int           // Stop after this many steps, 0 for no limit
+	timeout      time.Duration // Stop Run after this long, 0 for no limit
+	limited      StopReason    // Set to the limit that stopped the machine
+	overflow     OverflowPolicy
+	lenient      bool          // POP on an empty frame gives 0 instead of faulting
+	input        *bufio.Reader // Read by IN and INC
+	deadline     time.Time     // When the Run in progress times out, zero outside of Run or with no timeout
+	reads        chan byteRead // Results of the input reader started by the first read with a deadline
+	reading      bool          // A read has been asked of the input reader and not picked up yet
+	partialInt   []byte        // Digits IN had read when it timed out, it carries on from them
+	readRequests chan struct{} // Asks the input reader for one more byte
+	output       io.Writer     // Written to by OUT, OUTC and PEEK
+	debugLines   []palsm.DebugLine
+}
+
+// Option configures a VM when it is created with New
+type Option func(*VM)
+
+// WithStackSize sets the number of int32 slots in the operand stack
+func WithStackSize(size uint64) Option {
+	return func(vm *VM) {
+		vm.stackSize = size
+	}
+}
+
+// WithOverflow sets what arithmetic does with results that do not fit in an int32, the default is WRAP
+func WithOverflow(policy OverflowPolicy) Option {
+	return func(vm *VM) {
+		vm.overflow = policy
+	}
+}
+
+// WithInput sets where IN and INC read from, os.Stdin by default
+func WithInput(input io.Reader) Option {
+	return func(vm *VM) {
+		vm.input = bufio.NewReader(input)
+	}
+}
+
+// WithOutput sets where OUT, OUTC and PEEK write to, os.Stdout by default
+func WithOutput(output io.Writer) Option {
+	return func(vm *VM) {
+		vm.output = output
+	}
+}
+
+// WithLenientUnderflow makes POP on an empty stack frame give 0 rather than fault, as older versions of the VM did
+func WithLenientUnderflow() Option {
+	return func(vm *VM) {
+		vm.lenient = true
+	}
+}
+
+// WithDebugLines gives the machine the debug section of the image, so faults say which source line they came from
+func WithDebugLines(lines []palsm.DebugLine) Option {
+	return func(vm *VM) {
+		vm.debugLines = lines
+	}
+}
+
+// WithMemorySize sets the number of int32 words of data memory
+func WithMemorySize(size uint64) Option {
+	return func(vm *VM) {
+		vm.memSize = size
+	}
+}
+
+// WithData sets the initial contents of data memory, starting at address 0.
+// Data memory is grown to fit it if it is larger than the memory size.
+func WithData(data []int32) Option {
+	return func(vm *VM) {
+		vm.data = data
+	}
+}
+
+// WithEntry sets the address of the instruction execution starts at
+func WithEntry(entry int) Option {
+	return func(vm *VM) {
+		vm.entry = entry
+	}
+}
+
+// WithMaxSteps stops the machine with ErrStepLimit once it has executed steps instructions, 0 for no limit
+func WithMaxSteps(steps int) Option {
+	return func(vm *VM) {
+		vm.maxSteps = steps
+	}
+}
+
+// WithTimeout stops Run with ErrTimeout once it has been running for timeout, even while IN or INC wait on input, 0 for no limit
+func WithTimeout(timeout time.Duration) Option {
+	return func(vm *VM) {
+		vm.timeout = timeout
+	}
+}
+
+// New creates a VM ready to run the given program
+func New(program []uint32, opts ...Option) *VM {
+	vm := &VM{program: program, stackSize: DefaultStackSize, memSize: DefaultMemorySize, output: os.Stdout}
+	vm.instructions, vm.indexes = DecodeProgram(program)
+	for _, opt := range opts {
+		opt(vm)
+	}
+	if vm.input == nil {
+		vm.input = bufio.NewReader(os.Stdin)
+	}
+	vm.Reset()
+	return vm
+}
+
+// Reset puts the machine back to its initial state, keeping the loaded program
+func (vm *VM) Reset() {
+	vm.MemRegisters = [9]int32{}
+	vm.FlagRegister = false
+	vm.MemStack = InitMemStack(0, vm.stackSize)
+	if uint64(len(vm.data)) > vm.memSize {
+		vm.memSize = uint64(len(vm.data))
+	}
+	vm.Memory = make([]int32, vm.memSize)
+	copy(vm.Memory, vm.data)
+	vm.pc = vm.entry
+	vm.halted = false
+	vm.fault = nil
+	vm.steps = 0
+	vm.callDepth = 0
+	vm.limited = RUNNING
+}
+
+// Halted reports whether the program has executed a HALT instruction
+func (vm *VM) Halted() bool {
+	return vm.halted
+}
+
+// PC returns the program counter, the address of the next instruction to execute.
+// Addresses are word indexes into the program, the same ones the assembler gives labels.
+func (vm *VM) PC() int {
+	return vm.pc
+}
+
+// Program returns the words the machine is running
+func (vm *VM) Program() []uint32 {
+	return vm.program
+}
+
+// Source returns the source line of the instruction at addr as "loop.palsm:14 (in func)", or "" without debug lines
+func (vm *VM) Source(addr int) string {
+	if line, ok := palsm.FindDebugLine(vm.debugLines, addr); ok {
+		return line.String()
+	}
+	return ""
+}
+
+// CallDepth returns the number of CALLs still waiting on a RET
+func (vm *VM) CallDepth() int {
+	return vm.callDepth
+}
+
+// StackFrame returns the base and stack pointers along with the values of the current frame, from bp up to sp
+func (vm *VM) StackFrame() (uint32, uint32, []int32) {
+	memStack := &vm.MemStack
+	if memStack.sp < memStack.bp {
+		return memStack.bp, memStack.sp, nil
+	}
+	return memStack.bp, memStack.sp, memStack.stack[memStack.bp:memStack.sp]
+}
+
+// Result reports the current state of the machine as a Result
+func (vm *VM) Result() Result {
+	result := Result{IP: vm.pc, Steps: vm.steps}
+	switch {
+	case vm.fault != nil:
+		result.ExitStatus = 1
+		result.Stop = FAULTED
+	case vm.halted:
+		result.Stop = HALTED
+	case vm.limited != RUNNING:
+		result.ExitStatus = 2
+		result.Stop = vm.limited
+	case vm.pc >= len(vm.program):
+		result.Stop = END
+	}
+	return result
+}
+
+// Run function
+/*
+	Execute instructions from the program counter until the program halts, faults, runs off the end or hits a limit.
+	The clock is only checked every timeoutCheckSteps steps to keep it out of the way of the dispatch loop. IN and INC
+	waiting on input also give up at the deadline, see ReadByte.
+*/
+func (vm *VM) Run() (Result, error) {
+	var deadline time.Time
+	if vm.timeout > 0 {
+		deadline = time.Now().Add(vm.timeout)
+		vm.deadline = deadline
+		defer func() { vm.deadline = time.Time{} }()
+	}
+	for {
+		running, err := vm.Step()
+		if err != nil {
+			return vm.Result(), err
+		}
+		if !running {
+			return vm.Result(), nil
+		}
+		if vm.timeout > 0 && vm.steps%timeoutCheckSteps == 0 && time.Now().After(deadline) {
+			vm.limited = TIMEOUT
+			return vm.Result(), ErrTimeout
+		}
+	}
+}
+
+// Step decodes and executes the instruction at the program counter, returning false once the machine has stopped
+func (vm *VM) Step() (bool, error) {
+	if vm.fault != nil {
+		return false, vm.fault
+	}
+	if vm.halted || vm.pc >= len(vm.program) {
+		return false, nil
+	}
+	if vm.maxSteps > 0 && vm.steps >= vm.maxSteps {
+		vm.limited = STEP_LIMIT
+		return false, ErrStepLimit
+	}
+
+	instruction, err := vm.Fetch()
+	if err == nil {
+		before := vm.MemRegisters
+		var next int
+		next, err = vm.Execute(instruction)
+		if vm.tracer != nil {
+			vm.trace(instruction, before, err)
+		}
+		if err == nil {
+			vm.steps++
+			if vm.halted { // Leave the program counter on the HALT
+				return false, nil
+			}
+			vm.pc = next
+			return vm.pc < len(vm.program), nil
+		}
+		if err == ErrTimeout { // Ran out of time waiting on input, leave the program counter on the IN or INC
+			vm.limited = TIMEOUT
+			return false, err
+		}
+	}
+	vm.fault = &Fault{Err: err, IP: vm.pc, Word: instruction.Word, Source: vm.Source(vm.pc)}
+	return false, vm.fault
+}
+
+// Fetch the instruction at the program counter from the decoded program
+/*
+	Only jumps into the middle of an instruction, or past a word that could not be decoded, are decoded on the fly,
+	which is also where a bad word turns into a fault.
+*/
+func (vm *VM) Fetch() (*Instruction, error) {
+	if index := vm.indexes[vm.pc]; index >= 0 {
+		return &vm.instructions[index], nil
+	}
+	instruction, err := Decode(vm.program, vm.pc)
+	return &instruction, err
+}
+
+/*
+	Operand help functions
+*/
+// Read the value of an operand, the value of an indirect operand is the address it points at
+func (vm *VM) ResolveValue(operand Operand) int32 {
+	switch operand.Kind {
+	case REGISTER:
+		return vm.MemRegisters[operand.Value]
+	case INDIRECT:
+		return vm.MemRegisters[operand.Value] + operand.Offset
+	}
+	return operand.Value
+}
+
+// Store value in the register an operand names, returning an error if it is not a register
+func (vm *VM) StoreInRegister(operand Operand, val int32) error {
+	if operand.Kind != REGISTER {
+		return ErrInvalidRegister
+	}
+	vm.MemRegisters[operand.Value] = val
+	return nil
+}
+
+// Check an address lies inside data memory
+func (vm *VM) CheckAddress(address int32) error {
+	if address < 0 || int(address) >= len(vm.Memory) {
+		return ErrMemoryOutOfRange
+	}
+	return nil
+}
+
+// ArithmeticHelp
+/*
+	The result is worked out in 64 bits so overflow can be caught and handled by policy. MOD can't overflow,
+	math.MinInt32 / -1 is the one DIV that can.
+	The bitwise operations never overflow. BNOT only uses val1, and shift counts only use their low 5 bits (0 to 31).
+*/
+func ExecuteArithmatic(val1 int32, val2 int32, op ArithmeticOperation, policy OverflowPolicy) (int32, error) {
+	var result int64
+	switch op {
+	case ADD:
+		result = int64(val1) + int64(val2)
+	case SUB:
+		result = int64(val1) - int64(val2)
+	case MUL:
+		result = int64(val1) * int64(val2)
+	case DIV:
+		if val2 == 0 {
+			return 0, ErrDivideByZero
+		}
+		result = int64(val1) / int64(val2)
+	case MOD:
+		if val2 == 0 {
+			return 0, ErrDivideByZero
+		}
+		return val1 % val2, nil
+	case BAND:
+		return val1 & val2, nil
+	case BOR:
+		return val1 | val2, nil
+	case BXOR:
+		return val1 ^ val2, nil
+	case BNOT:
+		return ^val1, nil
+	case SHL:
+		return val1 << (uint32(val2) & 31), nil
+	case SHR:
+		return int32(uint32(val1) >> (uint32(val2) & 31)), nil
+	case SAR:
+		return val1 >> (uint32(val2) & 31), nil
+	}
+
+	if result >= math.MinInt32 && result <= math.MaxInt32 {
+		return int32(result), nil
+	}
+	switch policy {
+	case TRAP:
+		return 0, ErrOverflow
+	case SATURATE:
+		if result < 0 {
+			return math.MinInt32, nil
+		}
+		return math.MaxInt32, nil
+	}
+	return int32(result), nil
+}
+
+// The result goes into the first operand if it is a register, otherwise it is pushed onto the stack
+func (vm *VM) ArithmeticOperationHelper(args []Operand, op ArithmeticOperation) error {
+	var val2 int32
+	if len(args) > 1 { // BNOT only has the one
+		val2 = vm.ResolveValue(args[1])
+	}
+	result, err := ExecuteArithmatic(vm.ResolveValue(args[0]), val2, op, vm.overflow)
+	if err != nil {
+		return err
+	}
+	if args[0].Kind == REGISTER {
+		return vm.StoreInRegister(args[0], result)
+	}
+	return vm.MemStack.push(result)
+}
+
+// Boolean Operation Helper functions
+func ExecuteBooleanOperation(val1 int32, val2 int32, op BooleanOperation) bool {
+	switch op {
+	case AND:
+		return (val1 & val2) != 0
+	case OR:
+		return (val1 | val2) != 0
+	case GT:
+		return val1 > val2
+	case LT:
+		return val1 < val2
+	case GTE:
+		return val1 >= val2
+	case LTE:
+		return val1 <= val2
+	case EQ:
+		return val1 == val2
+	case NEQ:
+		return val1 != val2
+	}
+	return false
+}
+func (vm *VM) BooleanOperationHelper(args []Operand, op BooleanOperation) {
+	vm.FlagRegister = ExecuteBooleanOperation(vm.ResolveValue(args[0]), vm.ResolveValue(args[1]), op)
+}
+
+// Check a jump target lies inside the program, returning it as the next program counter
+func (vm *VM) Jump(address int32) (int, error) {
+	if address < 0 || int(address) >= len(vm.program) {
+		return 0, ErrJumpOutOfRange
+	}
+	return int(address), nil
+}
+
+// Read an integer from the input, skipping any whitespace before it. Returns false at the end of the input.
+// The digits read before a timeout are kept, and the next ReadInt, even after a Reset, carries on from them.
+func (vm *VM) ReadInt() (int32, bool, error) {
+	text := vm.partialInt
+	vm.partialInt = nil
+	for {
+		char, err := vm.ReadByte()
+		if err == ErrTimeout {
+			vm.partialInt = text
+			return 0, false, err
+		}
+		if err != nil { // The end of the input, an error reading it is treated the same
+			break
+		}
+		if char == ' ' || char == '\t' || char == '\n' || char == '\r' {
+			if len(text) > 0 {
+				break
+			}
+			continue
+		}
+		text = append(text, char)
+	}
+	if len(text) == 0 {
+		return 0, false, nil
+	}
+	val, err := strconv.ParseInt(string(text), 10, 32)
+	if err != nil {
+		return 0, true, ErrBadInput
+	}
+	return int32(val), true, nil
+}
+
+type byteRead struct {
+	char byte
+	err  error
+}
+
+// ReadByte function
+/*
+	Read the next byte of the input for IN and INC. While Run has a deadline the read is done by a goroutine of
+	its own so a program stuck waiting on input still stops with ErrTimeout. The goroutine only reads a byte when
+	asked to, and a byte that turns up after the deadline is kept for the next read. Once started every read goes
+	through it, and it is left blocked on the input if the VM is dropped in the middle of a read.
+*/
+func (vm *VM) ReadByte() (byte, error) {
+	if vm.deadline.IsZero() && vm.reads == nil {
+		return vm.input.ReadByte()
+	}
+	if vm.reads == nil {
+		vm.reads = make(chan byteRead, 1)
+		vm.readRequests = make(chan struct{})
+		go func(input *bufio.Reader, requests <-chan struct{}, reads chan<- byteRead) {
+			for range requests {
+				char, err := input.ReadByte()
+				reads <- byteRead{char, err}
+			}
+		}(vm.input, vm.readRequests, vm.reads)
+	}
+	if !vm.reading {
+		vm.readRequests <- struct{}{}
+		vm.reading = true
+	}
+	if vm.deadline.IsZero() {
+		read := <-vm.reads
+		vm.reading = false
+		return read.char, read.err
+	}
+	timer := time.NewTimer(time.Until(vm.deadline))
+	defer timer.Stop()
+	select {
+	case read := <-vm.reads:
+		vm.reading = false
+		return read.char, read.err
+	case <-timer.C:
+		return 0, ErrTimeout
+	}
+}
+
+// Call function
+/*
+	Push a new frame onto the stack and jump to the subroutine at address. A frame looks as such:
+		bp-2 -> return address (address of the instruction after the CALL)
+		bp-1 -> caller's bp
+	The callee's operands then start at the new bp, POP can't reach the caller's values below it and Return throws away
+	what the callee leaves above it, so arguments and results are passed in registers.
+*/
+func (vm *VM) Call(address int32, returnAddress int) (int, error) {
+	next, err := vm.Jump(address)
+	if err != nil {
+		return 0, err
+	}
+	memStack := &vm.MemStack
+	if err := memStack.push(int32(returnAddress)); err != nil {
+		return 0, err
+	}
+	if err := memStack.push(int32(memStack.bp)); err != nil {
+		return 0, err
+	}
+	memStack.bp = memStack.sp
+	vm.callDepth++
+	return next, nil
+}
+
+// Return function
+/*
+	Drop the current frame, restore the caller's bp and jump back to the return address
+*/
+func (vm *VM) Return() (int, error) {
+	if vm.callDepth == 0 {
+		return 0, ErrEmptyCallStack
+	}
+	memStack := &vm.MemStack
+	memStack.sp = memStack.bp
+	memStack.bp = uint32(memStack.stack[memStack.sp-1])
+	returnAddress := memStack.stack[memStack.sp-2]
+	memStack.sp -= 2
+	vm.callDepth--
+	return vm.Jump(returnAddress)
+}
+
+// Execute function
+/*
+	Execute a decoded instruction, returning the address of the next instruction to run.
+	OPCodes:
+		0 -> Halt
+		1 -> Peek stack
+		2 -> Addition
+		3 -> Subtraction
+		4 -> Multiplication
+		5 -> Division
+		6 -> AND
+		7 -> OR
+		8 -> PUSH
+		9 -> POP
+		10 -> MOV
+		11 -> EQ
+		12 -> NEQ
+		13 -> GT
+		14 -> LT
+		15 -> GTE
+		16 -> LTE
+		17 -> JMP
+		18 -> JMPF
+		19 -> CALL
+		20 -> RET
+		21 -> LOAD
+		22 -> STORE
+		23 -> Modulo
+		24 -> Bitwise AND
+		25 -> Bitwise OR
+		26 -> Bitwise XOR
+		27 -> Bitwise NOT
+		28 -> Shift left
+		29 -> Logical shift right
+		30 -> Arithmetic shift right
+		31 -> Print an int
+		32 -> Print a char
+		33 -> Read an int, the flag is set at the end of the input
+		34 -> Read a byte, the flag is set (and -1 read) at the end of the input
+*/
+func (vm *VM) Execute(instruction *Instruction) (int, error) {
+	memStack := &vm.MemStack
+	args := instruction.Args
+	next := instruction.Addr + instruction.Size
+	switch instruction.OpCode {
+	case 0: // HALT
+		vm.halted = true
+	case 1: // PEEK
+		fmt.Fprintf(vm.output, "[0x%X] Top of stack is: %d\n", instruction.Addr, memStack.peek())
+	case 2: // ADD
+		return next, vm.ArithmeticOperationHelper(args, ADD)
+	case 3: // SUB
+		return next, vm.ArithmeticOperationHelper(args, SUB)
+	case 4: // MUL
+		return next, vm.ArithmeticOperationHelper(args, MUL)
+	case 5: // DIV
+		return next, vm.ArithmeticOperationHelper(args, DIV)
+	case 6: // AND
+		vm.BooleanOperationHelper(args, AND)
+	case 7: // OR
+		vm.BooleanOperationHelper(args, OR)
+	case 8: // PUSH
+		return next, memStack.push(vm.ResolveValue(args[0]))
+	case 9: // POP
+		val, err := memStack.pop()
+		if err != nil && !vm.lenient {
+			return next, err
+		}
+		return next, vm.StoreInRegister(args[0], val)
+	case 10: // MOV
+		return next, vm.StoreInRegister(args[0], vm.ResolveValue(args[1]))
+	case 11: // EQ
+		vm.BooleanOperationHelper(args, EQ)
+	case 12: // NEQ
+		vm.BooleanOperationHelper(args, NEQ)
+	case 13: // GT
+		vm.BooleanOperationHelper(args, GT)
+	case 14: // LT
+		vm.BooleanOperationHelper(args, LT)
+	case 15: // GTE
+		vm.BooleanOperationHelper(args, GTE)
+	case 16: // LTE
+		vm.BooleanOperationHelper(args, LTE)
+	case 17: // JMP
+		return vm.Jump(vm.ResolveValue(args[0]))
+	case 18: // JMPF
+		if vm.FlagRegister {
+			return vm.Jump(vm.ResolveValue(args[0]))
+		}
+	case 19: // CALL
+		return vm.Call(vm.ResolveValue(args[0]), next)
+	case 20: // RET
+		return vm.Return()
+	case 21: // LOAD
+		address := vm.ResolveValue(args[1])
+		if err := vm.CheckAddress(address); err != nil {
+			return next, err
+		}
+		return next, vm.StoreInRegister(args[0], vm.Memory[address])
+	case 22: // STORE
+		address := vm.ResolveValue(args[0])
+		if err := vm.CheckAddress(address); err != nil {
+			return next, err
+		}
+		vm.Memory[address] = vm.ResolveValue(args[1])
+	case 23: // MOD
+		return next, vm.ArithmeticOperationHelper(args, MOD)
+	case 24: // BAND
+		return next, vm.ArithmeticOperationHelper(args, BAND)
+	case 25: // BOR
+		return next, vm.ArithmeticOperationHelper(args, BOR)
+	case 26: // BXOR
+		return next, vm.ArithmeticOperationHelper(args, BXOR)
+	case 27: // BNOT
+		return next, vm.ArithmeticOperationHelper(args, BNOT)
+	case 28: // SHL
+		return next, vm.ArithmeticOperationHelper(args, SHL)
+	case 29: // SHR
+		return next, vm.ArithmeticOperationHelper(args, SHR)
+	case 30: // SAR
+		return next, vm.ArithmeticOperationHelper(args, SAR)
+	case 31: // OUT
+		fmt.Fprintf(vm.output, "%d", vm.ResolveValue(args[0]))
+	case 32: // OUTC
+		vm.output.Write([]byte{byte(vm.ResolveValue(args[0]))}) // Only the low 8 bits, so INC and OUTC copy input byte for byte
+	case 33: // IN
+		val, ok, err := vm.ReadInt()
+		if err != nil {
+			return next, err
+		}
+		vm.FlagRegister = !ok
+		return next, vm.StoreInRegister(args[0], val)
+	case 34: // INC
+		val := int32(-1)
+		char, err := vm.ReadByte()
+		if err == ErrTimeout {
+			return next, err
+		}
+		if err == nil {
+			val = int32(char)
+		}
+		vm.FlagRegister = err != nil
+		return next, vm.StoreInRegister(args[0], val)
+	default:
+		return next, ErrUnknownOpCode
+	}
+	return next, nil
+}
@@ -0,0 +1,356 @@
+package palvm_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"pal/palvm"
+	"palsm/palexer"
+	palsm "palsm/palsm_h"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Assemble src and run it to the end, the program's output is thrown away
+func run(t *testing.T, src string, opts ...palvm.Option) (*palvm.VM, palvm.Result, error) {
+	t.Helper()
+	program, diagnostics, err := palexer.Assemble(src)
+	if err != nil {
+		t.Fatalf("assembling %q: %v", src, diagnostics)
+	}
+	opts = append([]palvm.Option{palvm.WithData(program.Data), palvm.WithOutput(io.Discard)}, opts...)
+	vm := palvm.New(program.Code, opts...)
+	result, err := vm.Run()
+	return vm, result, err
+}
+
+func TestComparisons(t *testing.T) {
+	cases := []struct {
+		a, b                      int64
+		eq, neq, gt, lt, gte, lte bool
+	}{
+		{0, 0, true, false, false, false, true, true},
+		{-1, 0, false, true, false, true, false, true},
+		{0, -1, false, true, true, false, true, false},
+		{-1, -1, true, false, false, false, true, true},
+		{math.MinInt32, math.MaxInt32, false, true, false, true, false, true},
+		{math.MaxInt32, math.MinInt32, false, true, true, false, true, false},
+		{math.MinInt32, math.MinInt32, true, false, false, false, true, true},
+		{math.MaxInt32, math.MaxInt32, true, false, false, false, true, true},
+		{1073741823, 1073741824, false, true, false, true, false, true},
+		{-1073741824, -1073741823, false, true, false, true, false, true},
+	}
+	for _, c := range cases {
+		expected := map[string]bool{"EQ": c.eq, "NEQ": c.neq, "GT": c.gt, "LT": c.lt, "GTE": c.gte, "LTE": c.lte}
+		for _, op := range []string{"EQ", "NEQ", "GT", "LT", "GTE", "LTE"} {
+			// Compare two registers, and a register against an immediate
+			for _, src := range []string{
+				fmt.Sprintf("MOV R1 %d\nMOV R2 %d\n%s R1 R2", c.a, c.b, op),
+				fmt.Sprintf("MOV R1 %d\n%s R1 %d", c.a, op, c.b),
+			} {
+				vm, _, err := run(t, src)
+				if err != nil {
+					t.Errorf("%q: %v", src, err)
+				} else if vm.FlagRegister != expected[op] {
+					t.Errorf("%s %d %d: flag is %t, expected %t", op, c.a, c.b, vm.FlagRegister, expected[op])
+				}
+			}
+		}
+	}
+}
+
+func TestArithmeticOverflowPolicies(t *testing.T) {
+	const min, max = math.MinInt32, math.MaxInt32
+	ops := map[string]palvm.ArithmeticOperation{"ADD": palvm.ADD, "SUB": palvm.SUB, "MUL": palvm.MUL, "DIV": palvm.DIV, "MOD": palvm.MOD}
+	cases := []struct {
+		op                string
+		a, b              int32
+		wrap, saturate    int32
+		overflows, byZero bool
+	}{
+		{"ADD", 2, 3, 5, 5, false, false},
+		{"ADD", max, 1, min, max, true, false},
+		{"ADD", min, -1, max, min, true, false},
+		{"SUB", min, 1, max, min, true, false},
+		{"SUB", max, -1, min, max, true, false},
+		{"SUB", -5, 7, -12, -12, false, false},
+		{"MUL", 65536, 65536, 0, max, true, false},
+		{"MUL", min, -1, min, max, true, false},
+		{"MUL", -32768, 65536, min, min, false, false},
+		{"DIV", min, -1, min, max, true, false},
+		{"DIV", -7, 2, -3, -3, false, false},
+		{"DIV", 7, 0, 0, 0, false, true},
+		{"MOD", min, -1, 0, 0, false, false},
+		{"MOD", -7, 2, -1, -1, false, false},
+		{"MOD", 7, 0, 0, 0, false, true},
+	}
+	for _, c := range cases {
+		for _, policy := range []palvm.OverflowPolicy{palvm.WRAP, palvm.TRAP, palvm.SATURATE} {
+			result, err := palvm.ExecuteArithmatic(c.a, c.b, ops[c.op], policy)
+			name := fmt.Sprintf("%s %d %d (%s)", c.op, c.a, c.b, policy)
+			switch {
+			case c.byZero:
+				if !errors.Is(err, palvm.ErrDivideByZero) {
+					t.Errorf("%s: expected division by zero, got %d, %v", name, result, err)
+				}
+			case c.overflows && policy == palvm.TRAP:
+				if !errors.Is(err, palvm.ErrOverflow) {
+					t.Errorf("%s: expected an overflow fault, got %d, %v", name, result, err)
+				}
+			case err != nil:
+				t.Errorf("%s: unexpected error %v", name, err)
+			case policy == palvm.SATURATE && result != c.saturate:
+				t.Errorf("%s: got %d, expected %d", name, result, c.saturate)
+			case policy != palvm.SATURATE && result != c.wrap:
+				t.Errorf("%s: got %d, expected %d", name, result, c.wrap)
+			}
+		}
+	}
+}
+
+// The same edge cases run as programs, so the policy is also checked on its way through WithOverflow
+func TestOverflowPolicyInPrograms(t *testing.T) {
+	src := "MOV R1 -2147483648\nDIV R1 -1"
+	vm, _, err := run(t, src, palvm.WithOverflow(palvm.WRAP))
+	if err != nil || vm.MemRegisters[0] != math.MinInt32 {
+		t.Errorf("wrap: R1 = %d, %v", vm.MemRegisters[0], err)
+	}
+	vm, _, err = run(t, src, palvm.WithOverflow(palvm.SATURATE))
+	if err != nil || vm.MemRegisters[0] != math.MaxInt32 {
+		t.Errorf("saturate: R1 = %d, %v", vm.MemRegisters[0], err)
+	}
+	_, result, err := run(t, src, palvm.WithOverflow(palvm.TRAP))
+	if !errors.Is(err, palvm.ErrOverflow) || result.Stop != palvm.FAULTED {
+		t.Errorf("trap: expected an overflow fault, got %v", err)
+	}
+	vm, _, err = run(t, "MOV R1 -2147483648\nMOD R1 -1", palvm.WithOverflow(palvm.TRAP))
+	if err != nil || vm.MemRegisters[0] != 0 {
+		t.Errorf("MOD by -1: R1 = %d, %v", vm.MemRegisters[0], err)
+	}
+	if _, _, err = run(t, "MOV R1 1\nDIV R1 0"); !errors.Is(err, palvm.ErrDivideByZero) {
+		t.Errorf("DIV by 0: expected division by zero, got %v", err)
+	}
+}
+
+// Operands are shown as written, a wide immediate as its value rather than the words it takes up
+func TestOperandString(t *testing.T) {
+	program, diagnostics, err := palexer.Assemble("MOV R1 2000000000\nSTORE [R3-2] -5\nLOAD R2 [R4]")
+	if err != nil {
+		t.Fatalf("assembling: %v", diagnostics)
+	}
+	instructions, _ := palvm.DecodeProgram(program.Code)
+	expected := [][]string{{"R1", "2000000000"}, {"[R3-2]", "-5"}, {"R2", "[R4]"}}
+	for i, operands := range expected {
+		var got []string
+		for _, arg := range instructions[i].Args {
+			got = append(got, arg.String())
+		}
+		if fmt.Sprint(got) != fmt.Sprint(operands) {
+			t.Errorf("instruction %d: operands %v, expected %v", i, got, operands)
+		}
+	}
+}
+
+func TestTimeoutWhileWaitingOnInput(t *testing.T) {
+	for _, src := range []string{"IN R1\nOUT R1", "INC R1\nOUT R1"} {
+		reader, writer := io.Pipe() // Never written to, so the read blocks until the deadline
+		start := time.Now()
+		vm, result, err := run(t, src, palvm.WithInput(reader), palvm.WithTimeout(50*time.Millisecond))
+		if err != palvm.ErrTimeout || result.Stop != palvm.TIMEOUT {
+			t.Errorf("%q: got %v stopped by %v, expected a timeout", src, err, result.Stop)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%q: took %v to time out", src, elapsed)
+		}
+
+		// The byte that turns up late is still there for the next run
+		writer.Write([]byte("7 "))
+		vm.Reset()
+		if _, err := vm.Run(); err != nil {
+			t.Errorf("%q: rerun after the input turned up: %v", src, err)
+		}
+		writer.Close()
+	}
+}
+
+func TestExpressionsInPrograms(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{"MOV R1 0x1F+0b1010*0o2\nOUT R1", "51"},
+		{"MOV R1 1_000_000\nOUT R1", "1000000"},
+		{"OUTC 'h'\nOUTC 'i'\nOUTC '\\n'", "hi\n"},
+		{".equ N 6\nMOV R1 (N+1)*N\nOUT R1", "42"},
+		{"JMP LABEL+2\nLABEL:\nOUT 1\nOUT 2", "2"}, // OUT 1 is two words long
+		{"MOV R1 later*10\nOUT R1\nlater:", "50"},
+		{".data\ntable: .word 1, 2, 3\n.text\nLOAD R1 table+2\nOUT R1", "3"},
+		// Wide parameters using a label declared after them
+		{"MOV R1 2000000000/(later+1)\nOUT R1\nlater:", "285714285"}, // later is 6,
+		{"MOV R1 later-2000000000\nOUT R1\nlater:", "-1999999994"},
+	}
+	for _, c := range cases {
+		var out strings.Builder
+		_, result, err := run(t, c.src, palvm.WithOutput(&out))
+		if err != nil || result.Stop != palvm.HALTED || out.String() != c.expected {
+			t.Errorf("%q: printed %q and stopped with %v, %v, expected %q", c.src, out.String(), result.Stop, err, c.expected)
+		}
+	}
+}
+
+func TestCopyInputToOutput(t *testing.T) {
+	src := "loop:\nINC R1\nJMPF done\nOUTC R1\nJMP loop\ndone:"
+	input := "caf\xc3\xa9 \x00\xff\n"
+	var out strings.Builder
+	if _, _, err := run(t, src, palvm.WithInput(strings.NewReader(input)), palvm.WithOutput(&out)); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if out.String() != input {
+		t.Errorf("copied % X, expected % X", out.String(), input)
+	}
+
+	// OUTC writes the low 8 bits of the value
+	out.Reset()
+	if _, _, err := run(t, "OUTC 0x141\nOUTC -1", palvm.WithOutput(&out)); err != nil || out.String() != "A\xff" {
+		t.Errorf("printed % X, %v, expected 41 FF", out.String(), err)
+	}
+}
+
+func TestTimeoutInTheMiddleOfAnInt(t *testing.T) {
+	reader, writer := io.Pipe()
+	go writer.Write([]byte("12"))
+	var out strings.Builder
+	vm, _, err := run(t, "IN R1\nOUT R1", palvm.WithInput(reader), palvm.WithOutput(&out), palvm.WithTimeout(100*time.Millisecond))
+	if err != palvm.ErrTimeout {
+		t.Fatalf("got %v, expected a timeout", err)
+	}
+
+	// The digits read before the timeout are the start of the int the next run reads
+	go writer.Write([]byte("3 "))
+	vm.Reset()
+	if _, err := vm.Run(); err != nil || out.String() != "123" {
+		t.Errorf("rerun printed %q, %v, expected 123", out.String(), err)
+	}
+	writer.Close()
+}
+
+func TestCallAndReturn(t *testing.T) {
+	cases := []struct {
+		name     string
+		src      string
+		opts     []palvm.Option
+		expected string
+		err      error
+	}{
+		{"nested calls", "CALL f\nOUT 3\nHALT\nf:\nOUT 1\nCALL g\nOUT 2\nRET\ng:\nPUSH 9\nPUSH 9\nOUT 0\nRET", nil, "1023", nil},
+		{"registers carry arguments and results", "MOV R1 5\nCALL square\nOUT R1\nHALT\nsquare:\nPUSH R2\nMOV R2 R1\nMUL R1 R2\nPOP R2\nRET", nil, "25", nil},
+		{"recursion", "MOV R1 4\nMOV R2 1\nCALL fact\nOUT R2\nHALT\nfact:\nEQ R1 0\nJMPF done\nMUL R2 R1\nSUB R1 1\nCALL fact\ndone:\nRET", nil, "24", nil},
+		{"RET with an empty call stack", "OUT 1\nRET", nil, "1", palvm.ErrEmptyCallStack},
+		{"RET after the call returned", "CALL f\nRET\nf:\nRET", nil, "", palvm.ErrEmptyCallStack},
+		{"callee can't POP the caller's values", "PUSH 5\nCALL f\nHALT\nf:\nPOP R1\nRET", nil, "", palvm.ErrStackUnderflow},
+		{"overflow pushing the return address", "PUSH 1\nCALL f\nHALT\nf:\nRET", []palvm.Option{palvm.WithStackSize(1)}, "", palvm.ErrStackOverflow},
+		{"overflow pushing the caller's bp", "PUSH 1\nCALL f\nHALT\nf:\nRET", []palvm.Option{palvm.WithStackSize(2)}, "", palvm.ErrStackOverflow},
+		{"deep recursion overflows", "f:\nCALL f", []palvm.Option{palvm.WithStackSize(100)}, "", palvm.ErrStackOverflow},
+	}
+	for _, c := range cases {
+		var out strings.Builder
+		vm, result, err := run(t, c.src, append(c.opts, palvm.WithOutput(&out))...)
+		if !errors.Is(err, c.err) || out.String() != c.expected {
+			t.Errorf("%s: printed %q with %v, expected %q with %v", c.name, out.String(), err, c.expected, c.err)
+		}
+		if c.err == nil && (result.Stop != palvm.HALTED || vm.CallDepth() != 0) {
+			t.Errorf("%s: stopped with %v at call depth %d", c.name, result.Stop, vm.CallDepth())
+		}
+		if c.err == nil {
+			if _, sp, _ := vm.StackFrame(); sp != 0 {
+				t.Errorf("%s: %d values left on the stack", c.name, sp)
+			}
+		}
+	}
+}
+
+func TestBitwiseOperations(t *testing.T) {
+	ops := map[string]palvm.ArithmeticOperation{"BAND": palvm.BAND, "BOR": palvm.BOR, "BXOR": palvm.BXOR, "BNOT": palvm.BNOT, "SHL": palvm.SHL, "SHR": palvm.SHR, "SAR": palvm.SAR}
+	cases := []struct {
+		op       string
+		a, b     int32
+		expected int32
+	}{
+		{"BAND", 12, 10, 8},
+		{"BAND", -1, 0x7F, 0x7F},
+		{"BOR", 12, 10, 14},
+		{"BOR", math.MinInt32, 1, math.MinInt32 + 1},
+		{"BXOR", 12, 10, 6},
+		{"BXOR", -1, 0x0F, -16},
+		{"BNOT", 0, 0, -1},
+		{"BNOT", 5, 1000, -6}, // Only the one operand
+		{"BNOT", math.MaxInt32, 0, math.MinInt32},
+		{"SHL", 1, 4, 16},
+		{"SHL", 1, 31, math.MinInt32},
+		{"SHL", 3, 32, 3}, // Shift counts only use their low 5 bits
+		{"SHL", 3, 33, 6},
+		{"SHL", 3, -1, math.MinInt32},
+		{"SHR", -16, 2, 0x3FFFFFFC}, // SHR fills with zeros
+		{"SAR", -16, 2, -4},         // SAR keeps the sign
+		{"SHR", -1, 31, 1},
+		{"SAR", -1, 31, -1},
+		{"SHR", -16, 32, -16},
+		{"SAR", -16, 34, -4},
+		{"SHR", 16, 2, 4},
+		{"SAR", 16, 2, 4},
+	}
+	for _, c := range cases {
+		// Bitwise results never overflow, so the policy doesn't matter
+		result, err := palvm.ExecuteArithmatic(c.a, c.b, ops[c.op], palvm.TRAP)
+		if err != nil || result != c.expected {
+			t.Errorf("%s %d %d: got %d, %v, expected %d", c.op, c.a, c.b, result, err, c.expected)
+		}
+	}
+}
+
+func TestBitwiseDestinations(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{"MOV R1 12\nBAND R1 10\nOUT R1", "8"},
+		{"MOV R1 12\nMOV R2 10\nBXOR R1 R2\nOUT R1\nOUT R2", "610"},
+		{"MOV R1 5\nBNOT R1\nOUT R1", "-6"},
+		{"MOV R1 -16\nMOV R2 2\nSAR R1 R2\nOUT R1", "-4"},
+		{"MOV R1 1\nMOV R2 33\nSHL R1 R2\nOUT R1", "2"}, // Counts from a register are masked at run time
+		// With an int in front the result is pushed onto the stack instead
+		{"BOR 12 10\nPOP R1\nOUT R1", "14"},
+		{"BNOT 0\nPOP R1\nOUT R1", "-1"},
+		{"SHR -16 28\nPOP R1\nOUT R1", "15"},
+	}
+	for _, c := range cases {
+		var out strings.Builder
+		_, result, err := run(t, c.src, palvm.WithOutput(&out))
+		if err != nil || result.Stop != palvm.HALTED || out.String() != c.expected {
+			t.Errorf("%q: printed %q and stopped with %v, %v, expected %q", c.src, out.String(), result.Stop, err, c.expected)
+		}
+	}
+}
+
+func TestFaultSource(t *testing.T) {
+	src := "MAIN:\n\tMOV R1 0\n\tCALL DIVIDE\n\tHALT\nDIVIDE:\n\tMOV R2 1\n\tDIV R2 R1\n\tRET"
+	program, diagnostics, err := palexer.AssembleFile("div.palsm", src)
+	if err != nil {
+		t.Fatalf("assembling: %v", diagnostics)
+	}
+	for _, debug := range [][]palsm.DebugLine{program.DebugLines(), nil} {
+		vm := palvm.New(program.Code, palvm.WithDebugLines(debug), palvm.WithOutput(io.Discard))
+		_, err := vm.Run()
+		if !errors.Is(err, palvm.ErrDivideByZero) {
+			t.Fatalf("got %v, expected division by zero", err)
+		}
+		at := strings.Contains(err.Error(), " at div.palsm:7 (in DIVIDE)")
+		if debug != nil && !at {
+			t.Errorf("%q does not give the source line", err.Error())
+		} else if debug == nil && strings.Contains(err.Error(), " at ") {
+			t.Errorf("%q gives a source line with no debug lines", err.Error())
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package palvm
+
+// TraceEvent describes a single executed instruction, handed to the tracer after it has run
+type TraceEvent struct {
+	Instruction *Instruction
+	Before      [9]int32 // Registers before the instruction ran
+	After       [9]int32 // Registers after the instruction ran
+	Flag        bool     // Flag register after the instruction ran
+	StackDepth  int      // Number of values on the stack after the instruction ran
+	Err         error    // Set if the instruction faulted
+}
+
+// Tracer is called by the machine once for every instruction it executes
+type Tracer func(event TraceEvent)
+
+// WithTracer has the machine call tracer after every instruction it executes
+func WithTracer(tracer Tracer) Option {
+	return func(vm *VM) {
+		vm.tracer = tracer
+	}
+}
+
+// Hand an executed instruction to the tracer
+func (vm *VM) trace(instruction *Instruction, before [9]int32, err error) {
+	vm.tracer(TraceEvent{
+		Instruction: instruction,
+		Before:      before,
+		After:       vm.MemRegisters,
+		Flag:        vm.FlagRegister,
+		StackDepth:  int(vm.MemStack.sp),
+		Err:         err,
+	})
+}
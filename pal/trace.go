@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"pal/palvm"
+	"palsm/palexer"
+	palsm "palsm/palsm_h"
+	"strconv"
+	"strings"
+)
+
+// TraceWriter writes a line for every traced instruction, either as text columns or as JSON Lines
+type TraceWriter struct {
+	out     io.Writer
+	json    bool
+	program []uint32
+	from    int // First address traced
+	to      int // Last address traced, -1 for no limit
+	opCodes map[string]bool
+	debug   []palsm.DebugLine // Source lines of the image, shown along with each instruction when there are any
+}
+
+// TraceLine is the JSON form of a traced instruction
+type TraceLine struct {
+	Addr     int              `json:"addr"`
+	Op       string           `json:"op"`
+	Operands []string         `json:"operands"`
+	Regs     map[string]int32 `json:"regs"` // Registers the instruction changed, along with their new value
+	Flag     bool             `json:"flag"`
+	Depth    int              `json:"depth"`
+	Error    string           `json:"error,omitempty"`
+	Source   string           `json:"source,omitempty"` // file:line the instruction was assembled from
+	Func     string           `json:"func,omitempty"`
+}
+
+// NewTraceWriter function
+/*
+	Create a TraceWriter for program. format is text or json, addresses is an inclusive range such as 0x10-0x20
+	(either end may be left out) and opCodes a comma separated list of mnemonics, both empty to trace everything.
+*/
+func NewTraceWriter(out io.Writer, program []uint32, debug []palsm.DebugLine, format string, addresses string, opCodes string) (*TraceWriter, error) {
+	writer := &TraceWriter{out: out, program: program, debug: debug, to: -1}
+	switch format {
+	case "text":
+	case "json":
+		writer.json = true
+	default:
+		return nil, fmt.Errorf("unknown trace format '%s', expected text or json", format)
+	}
+
+	if addresses != "" {
+		from, to, found := strings.Cut(addresses, "-")
+		var err error
+		if from != "" {
+			if writer.from, err = ParseTraceAddress(from); err != nil {
+				return nil, err
+			}
+		}
+		if !found {
+			writer.to = writer.from
+		} else if to != "" {
+			if writer.to, err = ParseTraceAddress(to); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if opCodes != "" {
+		writer.opCodes = make(map[string]bool)
+		for _, name := range strings.Split(opCodes, ",") {
+			name = strings.ToUpper(strings.TrimSpace(name))
+			if _, _, ok := palexer.LookupCommand(name); !ok {
+				return nil, fmt.Errorf("unknown op code '%s' in trace filter", name)
+			}
+			writer.opCodes[name] = true
+		}
+	}
+	return writer, nil
+}
+
+func ParseTraceAddress(text string) (int, error) {
+	address, err := strconv.ParseInt(strings.TrimSpace(text), 0, 64)
+	if err != nil || address < 0 {
+		return 0, fmt.Errorf("invalid trace address '%s'", text)
+	}
+	return int(address), nil
+}
+
+// Trace is the palvm.Tracer, writing the event if it passes the filters
+func (writer *TraceWriter) Trace(event palvm.TraceEvent) {
+	instruction := event.Instruction
+	if instruction.Addr < writer.from || (writer.to >= 0 && instruction.Addr > writer.to) {
+		return
+	}
+	words := writer.program[instruction.Addr : instruction.Addr+instruction.Size]
+	op := palexer.FormatWord(instruction.Word)
+	if writer.opCodes != nil && !writer.opCodes[op] {
+		return
+	}
+
+	line := TraceLine{Addr: instruction.Addr, Op: op, Operands: []string{}, Regs: map[string]int32{}, Flag: event.Flag, Depth: event.StackDepth}
+	for _, arg := range instruction.Args {
+		line.Operands = append(line.Operands, arg.String())
+	}
+	changes := []string{}
+	for i := range event.After {
+		if event.After[i] != event.Before[i] {
+			line.Regs[fmt.Sprintf("R%d", i+1)] = event.After[i]
+			changes = append(changes, fmt.Sprintf("R%d=%d", i+1, event.After[i]))
+		}
+	}
+	if event.Err != nil {
+		line.Error = event.Err.Error()
+	}
+	source, hasSource := palsm.FindDebugLine(writer.debug, instruction.Addr)
+	if hasSource {
+		line.Source = fmt.Sprintf("%s:%d", source.File, source.Line)
+		line.Func = source.Func
+	}
+
+	if writer.json {
+		encoded, _ := json.Marshal(line)
+		fmt.Fprintf(writer.out, "%s\n", encoded)
+		return
+	}
+	text := fmt.Sprintf("0x%04X  %-24s %-28s flag=%-5t depth=%d", line.Addr, palexer.FormatInstruction(words), strings.Join(changes, " "), line.Flag, line.Depth)
+	if hasSource {
+		text += "  " + source.String()
+	}
+	if line.Error != "" {
+		text += "  error: " + line.Error
+	}
+	fmt.Fprintln(writer.out, text)
+}
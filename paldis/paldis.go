@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"palsm/paldis"
+	palsm "palsm/palsm_h"
+)
+
+func main() {
+	output := flag.String("o", "", "write the source to this file instead of printing it")
+	allowRaw := flag.Bool("raw", false, "accept legacy .bin files with no header: raw big-endian code words, then optionally 0x7FFFFFFF followed by the data words")
+	flag.Usage = func() {
+		fmt.Println("Usage: ./paldis [options] <file.bin>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	image, err := palsm.ReadImageFile(flag.Arg(0), *allowRaw)
+	if err != nil {
+		fmt.Printf("ERROR: %s: %s\n", flag.Arg(0), err.Error())
+		os.Exit(1)
+	}
+
+	source, err := paldis.Disassemble(image)
+	if err != nil {
+		fmt.Printf("ERROR: %s: %s\n", flag.Arg(0), err.Error())
+		os.Exit(1)
+	}
+
+	if *output == "" {
+		fmt.Print(source)
+		return
+	}
+	if err := os.WriteFile(*output, []byte(source), 0644); err != nil {
+		fmt.Printf("ERROR: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"palsm/pallink"
+	palsm "palsm/palsm_h"
+	"path/filepath"
+)
+
+func main() {
+	output := flag.String("o", "", "write the program to this file, by default the first object's name with .bin")
+	strip := flag.Bool("strip", false, "leave out the debug section that maps instructions back to their source lines")
+	flag.Usage = func() {
+		fmt.Println("Usage: ./pallink [-o <file.bin>] [--strip] <file.o>...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var objects []pallink.Object
+	for _, fileName := range flag.Args() {
+		image, err := palsm.ReadImageFile(fileName, false)
+		if err != nil {
+			fmt.Printf("ERROR: %s: %s\n", fileName, err.Error())
+			os.Exit(1)
+		}
+		objects = append(objects, pallink.Object{Name: fileName, Image: image})
+	}
+
+	image, errs := pallink.Link(objects)
+	for _, err := range errs {
+		fmt.Printf("ERROR: %s\n", err.Error())
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+	if *strip {
+		image.Debug = nil
+	}
+
+	fileName := *output
+	if fileName == "" {
+		first := flag.Arg(0)
+		fileName = first[0:len(first)-len(filepath.Ext(first))] + ".bin"
+	}
+	if err := os.WriteFile(fileName, palsm.EncodeImage(image), 0644); err != nil {
+		fmt.Printf("ERROR: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
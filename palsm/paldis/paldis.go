@@ -0,0 +1,134 @@
+package paldis
+
+import (
+	"errors"
+	"fmt"
+	"palsm/palexer"
+	palsm "palsm/palsm_h"
+	"sort"
+	"strings"
+)
+
+var ErrTrailingOperands = errors.New("program ends with operands that have no op code")
+
+const dataWordsPerLine = 8
+
+/*
+	Disassemble turns an image back into .palsm source that assembles to the same code and data.
+	Labels come from the image's symbols, jump targets without one are given a synthesized label (L0006).
+	The HALT the assembler adds to the end of every program is left out, since assembling adds it back.
+*/
+func Disassemble(image palsm.Image) (string, error) {
+	code := image.Code
+	if len(code) > 0 && code[len(code)-1] == 0x40000000 {
+		code = code[:len(code)-1]
+	}
+
+	starts := palexer.InstructionStarts(code)
+	if len(starts) > 0 {
+		if _, ok := palexer.InstructionEnd(code, starts[len(starts)-1]); !ok {
+			return "", fmt.Errorf("%w (index 0x%04X)", ErrTrailingOperands, starts[len(starts)-1])
+		}
+	}
+
+	codeLabels := make(map[int][]string)
+	dataLabels := make(map[int][]string)
+	names := make(map[string]bool)
+	for _, symbol := range image.Symbols {
+		names[symbol.Name] = true
+		if symbol.Section == palsm.SECTION_DATA {
+			dataLabels[int(symbol.Value)] = append(dataLabels[int(symbol.Value)], symbol.Name)
+		} else {
+			codeLabels[int(symbol.Value)] = append(codeLabels[int(symbol.Value)], symbol.Name)
+		}
+	}
+
+	// Give every jump target a label
+	for _, start := range starts {
+		end, _ := palexer.InstructionEnd(code, start)
+		if !palexer.IsLabelCommand(code[end]) || end == start || code[start]>>30 != 0 {
+			continue
+		}
+		target := int(code[start])
+		if len(codeLabels[target]) == 0 {
+			name := fmt.Sprintf("L%04X", target)
+			for names[name] {
+				name += "_"
+			}
+			names[name] = true
+			codeLabels[target] = []string{name}
+		}
+	}
+
+	var builder strings.Builder
+	for _, start := range starts {
+		WriteLabels(&builder, codeLabels[start])
+		end, _ := palexer.InstructionEnd(code, start)
+		builder.WriteString("    " + FormatInstruction(code[start:end+1], codeLabels) + "\n")
+	}
+	// Labels on the end of the program, or pointing past the last instruction, go on the added HALT
+	for _, index := range SortedIndexes(codeLabels) {
+		if index >= len(code) {
+			WriteLabels(&builder, codeLabels[index])
+		}
+	}
+
+	if len(image.Data) > 0 || len(dataLabels) > 0 {
+		builder.WriteString(".data\n")
+		WriteData(&builder, image.Data, dataLabels)
+	}
+	return builder.String(), nil
+}
+
+// Format an instruction, using the target's label for the parameter of JMP, JMPF and CALL
+func FormatInstruction(words []uint32, codeLabels map[int][]string) string {
+	opCode := words[len(words)-1]
+	if palexer.IsLabelCommand(opCode) && len(words) == 2 && words[0]>>30 == 0 {
+		if labels := codeLabels[int(words[0])]; len(labels) > 0 {
+			return palexer.FormatWord(opCode) + " " + labels[0]
+		}
+	}
+	return palexer.FormatInstruction(words)
+}
+
+func WriteLabels(builder *strings.Builder, labels []string) {
+	for _, label := range labels {
+		builder.WriteString(label + ":\n")
+	}
+}
+
+// Write the .data section as .word lines, starting a new line at every label
+func WriteData(builder *strings.Builder, data []int32, dataLabels map[int][]string) {
+	line := []string{}
+	flush := func() {
+		if len(line) > 0 {
+			builder.WriteString("    .word " + strings.Join(line, ", ") + "\n")
+			line = line[:0]
+		}
+	}
+	for i, word := range data {
+		if labels := dataLabels[i]; len(labels) > 0 {
+			flush()
+			WriteLabels(builder, labels)
+		}
+		line = append(line, fmt.Sprintf("%d", word))
+		if len(line) == dataWordsPerLine {
+			flush()
+		}
+	}
+	flush()
+	for _, index := range SortedIndexes(dataLabels) {
+		if index >= len(data) {
+			WriteLabels(builder, dataLabels[index])
+		}
+	}
+}
+
+func SortedIndexes(labels map[int][]string) []int {
+	indexes := make([]int, 0, len(labels))
+	for index := range labels {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
@@ -0,0 +1,111 @@
+package paldis_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"pal/palvm"
+	"palsm/paldis"
+	"palsm/palexer"
+	palsm "palsm/palsm_h"
+	"testing"
+)
+
+// Values either side of the 30 bits a tagged word holds, and the ends of int32
+var boundaries = []int64{0, 1, -1, 1073741823, -1073741823, 1073741824, -1073741824, math.MaxInt32, math.MinInt32}
+
+func assemble(t *testing.T, src string) palexer.Program {
+	t.Helper()
+	program, diagnostics, err := palexer.Assemble(src)
+	if err != nil {
+		t.Fatalf("assembling %q: %v", src, diagnostics)
+	}
+	return program
+}
+
+// The .bin file palsm --strip writes for a program, the debug section points at the original source so it is left out
+func strippedImage(program palexer.Program) []byte {
+	image := program.Image()
+	image.Debug = nil
+	return palsm.EncodeImage(image)
+}
+
+// Disassemble program, reassemble the source and check it gives the same .bin file byte for byte
+func checkRoundTrip(t *testing.T, name string, program palexer.Program) {
+	t.Helper()
+	source, err := paldis.Disassemble(program.Image())
+	if err != nil {
+		t.Fatalf("%s: disassembling: %v", name, err)
+	}
+	again := assemble(t, source)
+	if !bytes.Equal(strippedImage(again), strippedImage(program)) {
+		t.Errorf("%s: reassembled to a different image, code %08X, expected %08X\n%s", name, again.Code, program.Code, source)
+	}
+}
+
+// Push an immediate through the assembler, palvm.Decode, the VM, the disassembler and back through the assembler
+func TestImmediateRoundTrip(t *testing.T) {
+	for _, value := range boundaries {
+		src := fmt.Sprintf("MOV R1 %d\nPUSH %d\n", value, value)
+		program := assemble(t, src)
+
+		for _, addr := range palexer.InstructionStarts(program.Code)[:2] {
+			instruction, err := palvm.Decode(program.Code, addr)
+			if err != nil {
+				t.Fatalf("%d: decoding 0x%X: %v", value, addr, err)
+			}
+			operand := instruction.Args[len(instruction.Args)-1]
+			if operand.Kind != palvm.IMMEDIATE || int64(operand.Value) != value {
+				t.Errorf("%d: decoded as %+v", value, operand)
+			}
+		}
+
+		vm := palvm.New(program.Code, palvm.WithOutput(io.Discard))
+		if _, err := vm.Run(); err != nil || int64(vm.MemRegisters[0]) != value {
+			t.Errorf("%d: R1 = %d after running, %v", value, vm.MemRegisters[0], err)
+		}
+
+		checkRoundTrip(t, fmt.Sprint(value), program)
+	}
+}
+
+// A label declared after the immediate using it is patched once it is known
+func TestForwardLabelImmediateRoundTrip(t *testing.T) {
+	src := "MOV R1 later+1000\nMOV R2 -1073741824\nlater:\nADD R1 later\n"
+	program := assemble(t, src)
+	later := int64(program.Labels["later"])
+
+	vm := palvm.New(program.Code, palvm.WithOutput(io.Discard))
+	if _, err := vm.Run(); err != nil || int64(vm.MemRegisters[0]) != 2*later+1000 || vm.MemRegisters[1] != -1073741824 {
+		t.Errorf("R1 = %d, R2 = %d after running, %v", vm.MemRegisters[0], vm.MemRegisters[1], err)
+	}
+
+	checkRoundTrip(t, "forward label", program)
+}
+
+func TestProgramRoundTrip(t *testing.T) {
+	src := `.data
+msg: .string "hi\n"
+table: .word 1, -2, 2147483647, msg
+buffer: .space 3
+.text
+MAIN:
+	MOV R1 0
+loop:
+	LOAD R2 [R1+msg]
+	EQ R2 0
+	JMPF done
+	OUTC R2
+	ADD R1 1
+	JMP loop
+done:
+	CALL PRINT
+	HALT
+PRINT:
+	PUSH R1
+	STORE [R1+buffer] R1
+	POP R1
+	RET`
+	checkRoundTrip(t, "program", assemble(t, src))
+}
@@ -0,0 +1,86 @@
+package palexer
+
+import (
+	palsm "palsm/palsm_h"
+	"sort"
+)
+
+// DebugLines function
+/*
+	Map every instruction to the line it was assembled from, for the debug section of the image. An instruction
+	that came from a macro is given the line the macro was used on. Its function is the closest label before it
+	that is CALLed or is .global, or just the closest label before it if there is no such label.
+*/
+func (program Program) DebugLines() []palsm.DebugLine {
+	type label struct {
+		name string
+		addr int
+	}
+	var labels []label
+	for name, addr := range program.Labels {
+		if !program.InData[name] {
+			labels = append(labels, label{name, addr})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].addr != labels[j].addr {
+			return labels[i].addr < labels[j].addr
+		}
+		return labels[i].name < labels[j].name
+	})
+	functions := program.FunctionEntries()
+	for _, name := range program.Globals {
+		if !program.InData[name] {
+			functions[program.Labels[name]] = true
+		}
+	}
+
+	var lines []palsm.DebugLine
+	for _, span := range program.Spans {
+		if span.InData {
+			continue
+		}
+		origin := program.Origin(span.Position)
+		column := span.Position.Column
+		for origin.Caller != nil {
+			origin = *origin.Caller
+			column = 1
+		}
+		line := palsm.DebugLine{Addr: uint32(span.Addr), File: origin.File, Line: uint32(origin.Line), Column: uint32(column)}
+
+		closest, function := "", ""
+		for _, label := range labels {
+			if label.addr > span.Addr {
+				break
+			}
+			closest = label.name
+			if functions[label.addr] {
+				function = label.name
+			}
+		}
+		if function == "" {
+			function = closest
+		}
+		line.Func = function
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// Find the addresses CALLed in the code, leaving out CALLs to a label in another object
+func (program Program) FunctionEntries() map[int]bool {
+	external := make(map[uint32]bool)
+	for _, relocation := range program.Relocations {
+		if _, ok := program.Labels[relocation.Symbol]; !ok && relocation.Section == palsm.SECTION_CODE {
+			external[relocation.Index] = true
+		}
+	}
+	entries := make(map[int]bool)
+	for _, start := range InstructionStarts(program.Code) {
+		end, ok := InstructionEnd(program.Code, start)
+		if ok && end == start+1 && program.Code[end] == 0x40000013 && program.Code[start]>>30 == 0 && !external[uint32(start)] {
+			entries[int(program.Code[start])] = true
+		}
+	}
+	return entries
+}
@@ -0,0 +1,52 @@
+package palexer
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDebugLineFunctions(t *testing.T) {
+	src := `MAIN:
+	MOV R1 1
+loop:
+	CALL PRINT
+	JMP loop
+PRINT:
+	OUT R1
+skip:
+	RET
+after:
+	HALT`
+	program, diagnostics, err := AssembleFile("main.palsm", src)
+	if err != nil {
+		t.Fatalf("assembling: %v", diagnostics)
+	}
+	var got []string
+	for _, line := range program.DebugLines() {
+		got = append(got, fmt.Sprintf("%d %s", line.Addr, line))
+	}
+	expected := []string{
+		"0 main.palsm:2 (in MAIN)", // No label before it is CALLed, so the closest one
+		"3 main.palsm:4 (in loop)",
+		"5 main.palsm:5 (in loop)",
+		"7 main.palsm:7 (in PRINT)", // CALLed, so skip is still in PRINT
+		"9 main.palsm:9 (in PRINT)",
+		"10 main.palsm:11 (in PRINT)", // after is not CALLed either
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("got\n%v\nexpected\n%v", got, expected)
+	}
+}
+
+func TestDebugLinesOfMacros(t *testing.T) {
+	src := ".macro TWICE reg\n\tADD reg reg\n.endm\nstart:\n\tTWICE R1\n\tOUT R1"
+	program, diagnostics, err := AssembleFile("macro.palsm", src)
+	if err != nil {
+		t.Fatalf("assembling: %v", diagnostics)
+	}
+	lines := program.DebugLines()
+	// An instruction from a macro is given the line the macro was used on
+	if len(lines) != 2 || lines[0].String() != "macro.palsm:5 (in start)" || lines[1].String() != "macro.palsm:6 (in start)" {
+		t.Errorf("unexpected lines %v", lines)
+	}
+}
@@ -0,0 +1,102 @@
+package palexer
+
+import (
+	"fmt"
+)
+
+type Severity int
+
+const (
+	ERROR   Severity = 0
+	WARNING Severity = 1
+	NOTE    Severity = 2
+)
+
+func (severity Severity) String() string {
+	switch severity {
+	case WARNING:
+		return "warning"
+	case NOTE:
+		return "note"
+	default:
+		return "error"
+	}
+}
+
+// Position of a character in the source, both line and column start counting at 1
+type Position struct {
+	Line   int
+	Column int
+}
+
+// Diagnostic is a single problem found while assembling a source file
+type Diagnostic struct {
+	File     string
+	Line     int
+	Column   int
+	Severity Severity
+	Message  string
+	Notes    []Diagnostic // Further locations, such as the macro invocations the line was expanded from
+}
+
+// String renders the diagnostic the way compilers do: "file:line:col: error: message"
+func (diagnostic Diagnostic) String() string {
+	file := diagnostic.File
+	if file == "" {
+		file = "<input>"
+	}
+	text := fmt.Sprintf("%s:%d:%d: %s: %s", file, diagnostic.Line, diagnostic.Column, diagnostic.Severity, diagnostic.Message)
+	for _, note := range diagnostic.Notes {
+		text += "\n" + note.String()
+	}
+	return text
+}
+
+// Most macro expansion notes given for a single diagnostic
+const maxNotes = 4
+
+// Record an error at the given position, a position in preprocessed source is reported where the line came from
+func (lexer *Lexer) Errorf(position Position, format string, args ...interface{}) {
+	origin := Origin{File: lexer.File, Line: position.Line}
+	if position.Line >= 1 && position.Line <= len(lexer.Lines) {
+		origin = lexer.Lines[position.Line-1]
+	}
+	lexer.ErrorAt(origin, position.Column, format, args...)
+}
+
+// Record an error on a line of the source, with a note for every macro invocation the line was expanded from
+func (lexer *Lexer) ErrorAt(origin Origin, column int, format string, args ...interface{}) {
+	diagnostic := Diagnostic{
+		File:     origin.File,
+		Line:     origin.Line,
+		Column:   column,
+		Severity: ERROR,
+		Message:  fmt.Sprintf(format, args...),
+	}
+	for caller := &origin; caller.Caller != nil; caller = caller.Caller {
+		diagnostic.Notes = append(diagnostic.Notes, Diagnostic{
+			File:     caller.Caller.File,
+			Line:     caller.Caller.Line,
+			Column:   1,
+			Severity: NOTE,
+			Message:  fmt.Sprintf("in expansion of macro '%s'", caller.Macro),
+		})
+	}
+	if notes := diagnostic.Notes; len(notes) > maxNotes { // Keep the innermost expansions and the one that started it all
+		skipped := Diagnostic{File: notes[maxNotes-1].File, Line: notes[maxNotes-1].Line, Column: 1, Severity: NOTE,
+			Message: fmt.Sprintf("(%d more expansions)", len(notes)-maxNotes)}
+		diagnostic.Notes = append(notes[:maxNotes-1:maxNotes-1], skipped, notes[len(notes)-1])
+	}
+	lexer.Diagnostics = append(lexer.Diagnostics, diagnostic)
+}
+
+// Count the diagnostics that are errors
+func (lexer *Lexer) ErrorCount() int {
+	count := 0
+	for _, diagnostic := range lexer.Diagnostics {
+		if diagnostic.Severity == ERROR {
+			count++
+		}
+	}
+	return count
+}
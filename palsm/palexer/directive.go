@@ -0,0 +1,225 @@
+package palexer
+
+import (
+	"fmt"
+	palsm "palsm/palsm_h"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+	Directives start with a '.' and control what the assembler does rather than producing instructions:
+		.data            -> following labels and values go into data memory
+		.text            -> following commands go back into the program
+		.word 1, 2, LBL  -> one data word per value, labels become their address, see Evaluate for what a value can be
+		.string "hello"  -> one data word per character, followed by a 0
+		.space 64        -> the given number of data words set to 0
+		.equ NAME 42     -> NAME can be used anywhere an int can
+		.global NAME     -> other objects may use the label NAME, see Relocate
+		.extern NAME     -> NAME is a label in another object
+*/
+func (lexer *Lexer) StartDirective() {
+	lexer.EndDirective()
+
+	switch lexer.BuiltString {
+	case ".data":
+		lexer.InData = true
+		return
+	case ".text":
+		lexer.InData = false
+		return
+	case ".word", ".string", ".space":
+		if !lexer.InData {
+			lexer.Errorf(lexer.TokenPosition, "directive '%s' can only be used in the .data section", lexer.BuiltString)
+		}
+	case ".equ":
+		lexer.EquName = ""
+	case ".global", ".extern":
+	default:
+		lexer.Errorf(lexer.TokenPosition, "unrecognized directive '%s'", lexer.BuiltString)
+		return
+	}
+	lexer.Directive = lexer.BuiltString
+	lexer.DirectivePosition = lexer.TokenPosition
+	lexer.DirectiveOpen = true
+}
+
+// Close the current directive, reporting an error if it never received its value
+func (lexer *Lexer) EndDirective() {
+	if lexer.DirectiveOpen {
+		lexer.Errorf(lexer.DirectivePosition, "directive '%s' was expecting a value", lexer.Directive)
+	}
+	lexer.Directive = ""
+	lexer.DirectiveOpen = false
+}
+
+// Hand the built string to the current directive, returning false if there isn't one waiting on a value
+func (lexer *Lexer) HandleDirectiveArgument() bool {
+	if !lexer.DirectiveOpen {
+		if IsListDirective(lexer.Directive) && lexer.BuiltString[0] == ',' { // "1 ,2" carries on the list
+			lexer.DirectiveOpen = true
+		} else {
+			return false
+		}
+	}
+	if _, _, isCommand := LookupCommand(lexer.BuiltString); isCommand || lexer.BuiltString[0] == '.' {
+		return false // Let the command or directive report the missing value when it ends this one
+	}
+
+	switch lexer.Directive {
+	case ".word":
+		for _, value := range SplitValues(lexer.BuiltString) {
+			if value != "" {
+				lexer.AddDataWord(value)
+			}
+		}
+		lexer.DirectiveOpen = strings.HasSuffix(lexer.BuiltString, ",")
+	case ".string":
+		lexer.DirectiveOpen = false
+		str, err := strconv.Unquote(lexer.BuiltString)
+		if lexer.BuiltString[0] != '"' || err != nil {
+			lexer.Errorf(lexer.TokenPosition, "invalid string %s", lexer.BuiltString)
+			break
+		}
+		if lexer.InData {
+			start := len(lexer.Data)
+			for _, char := range str {
+				lexer.Data = append(lexer.Data, int32(char))
+			}
+			lexer.Data = append(lexer.Data, 0)
+			lexer.AddSpan(start, lexer.TokenPosition, true)
+		}
+	case ".space":
+		lexer.DirectiveOpen = false
+		size, err := lexer.ParseValue(lexer.BuiltString)
+		if err != nil {
+			lexer.Errorf(lexer.TokenPosition, "invalid size: %s", err.Error())
+			break
+		} else if size < 0 {
+			lexer.Errorf(lexer.TokenPosition, "invalid size '%s'", lexer.BuiltString)
+			break
+		}
+		if lexer.InData {
+			lexer.Data = append(lexer.Data, make([]int32, size)...)
+			lexer.AddSpan(len(lexer.Data)-int(size), lexer.TokenPosition, true)
+		}
+	case ".global", ".extern":
+		for _, name := range SplitValues(lexer.BuiltString) {
+			if name != "" {
+				lexer.DeclareSymbol(name)
+			}
+		}
+		lexer.DirectiveOpen = strings.HasSuffix(lexer.BuiltString, ",")
+	case ".equ":
+		if lexer.EquName == "" {
+			lexer.EquName = lexer.BuiltString
+			if res, _ := regexp.MatchString("^[A-Za-z_][A-Za-z0-9_]*$", lexer.EquName); !res || IsRegisterName(lexer.EquName) {
+				lexer.Errorf(lexer.TokenPosition, "invalid constant name '%s'", lexer.EquName)
+			} else if _, ok := lexer.Constants[lexer.EquName]; ok {
+				lexer.Errorf(lexer.TokenPosition, "constant '%s' is declared more than once", lexer.EquName)
+			}
+			return true
+		}
+		lexer.DirectiveOpen = false
+		value, err := lexer.ParseValue(lexer.BuiltString)
+		if err != nil {
+			lexer.Errorf(lexer.TokenPosition, "invalid value for constant '%s': %s", lexer.EquName, err.Error())
+			break
+		}
+		if _, ok := lexer.Constants[lexer.EquName]; !ok {
+			lexer.Constants[lexer.EquName] = value
+		}
+	}
+	return true
+}
+
+// Add a word to the .data section, value can be an int, a constant, a label or an expression of them
+func (lexer *Lexer) AddDataWord(value string) {
+	if !lexer.InData {
+		return
+	}
+	num, unresolved, err := lexer.Evaluate(value)
+	if err == nil && len(unresolved) == 0 {
+		err = CheckInt32(value, num)
+	}
+	if err != nil {
+		lexer.Errorf(lexer.TokenPosition, "%s", err.Error())
+		return
+	}
+
+	if lexer.ExpressionUsesLabel(value) {
+		lexer.Relocate(palsm.SECTION_DATA, len(lexer.Data), value, false)
+	}
+	if len(unresolved) > 0 {
+		lexer.Fixups = append(lexer.Fixups, Fixup{Expression: value, Index: len(lexer.Data), InData: true, Position: lexer.TokenPosition})
+		for _, label := range unresolved {
+			lexer.LabelReferences[label] = append(lexer.LabelReferences[label], lexer.TokenPosition)
+		}
+	}
+	lexer.Data = append(lexer.Data, int32(num))
+	lexer.AddSpan(len(lexer.Data)-1, lexer.TokenPosition, true)
+}
+
+// Read a value that has to be known where it is written: an int, a constant, a label declared before it or an
+// expression of them
+func (lexer *Lexer) ParseValue(value string) (int32, error) {
+	num, unresolved, err := lexer.Evaluate(value)
+	if err != nil {
+		return 0, err
+	}
+	if len(unresolved) > 0 {
+		return 0, fmt.Errorf("label '%s' has to be declared before '%s'", unresolved[0], value)
+	}
+	if lexer.Object && lexer.ExpressionUsesLabel(value) {
+		return 0, fmt.Errorf("'%s' uses a label, whose address is not known in an object file until it is linked", value)
+	}
+	if err := CheckInt32(value, num); err != nil {
+		return 0, err
+	}
+	return int32(num), nil
+}
+
+// Check if the directive takes a comma separated list of values
+func IsListDirective(directive string) bool {
+	return directive == ".word" || directive == ".global" || directive == ".extern"
+}
+
+// Split a .word list on its commas, leaving commas inside char literals alone
+func SplitValues(list string) []string {
+	var values []string
+	start := 0
+	for i := 0; i < len(list); i++ {
+		if list[i] == ',' && OpenQuote(list[:i]) == 0 {
+			values = append(values, list[start:i])
+			start = i + 1
+		}
+	}
+	return append(values, list[start:])
+}
+
+// OpenQuote function
+/*
+	Find the quote ('"' or '\'') of a string or char literal left open at the end of str, or 0 if they are all closed.
+	A backslash inside a literal escapes the character after it.
+*/
+func OpenQuote(str string) byte {
+	var quote byte
+	for i := 0; i < len(str); i++ {
+		switch {
+		case quote == 0 && (str[i] == '"' || str[i] == '\''):
+			quote = str[i]
+		case quote != 0 && str[i] == '\\':
+			i++
+		case str[i] == quote:
+			quote = 0
+		}
+	}
+	return quote
+}
+
+// Check if the name is a register (R0-R9)
+func IsRegisterName(name string) bool {
+	res, _ := regexp.MatchString("^R[0-9]$", name)
+	return res
+}
@@ -0,0 +1,277 @@
+package palexer
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Fixup is a value that uses a label declared further down, worked out once the whole file has been lexed
+type Fixup struct {
+	Expression string
+	Index      int  // Index of the word to patch in the program, or in the data when InData is set
+	InData     bool // Set for .word values
+	Wide       bool // The parameter is a palsm.WideImmediate at Index, the raw value after it is patched
+	Position   Position
+}
+
+// Largest absolute value an intermediate result of an expression may reach
+const maxExpressionValue = 1 << 40
+
+// An expression being read, one character at a time
+type expression struct {
+	lexer      *Lexer
+	text       string
+	pos        int
+	unresolved []string // Labels that have not been declared yet, they count as 0
+	labels     bool     // Set if any label is used
+}
+
+// Evaluate function
+/*
+	Work out the value of an expression, returning it along with the labels in it that have not been declared yet.
+	Expressions are written without spaces and are made up of:
+		numbers   -> 42, 0x1F, 0b1010, 0o17, with '_' allowed between digits (1_000_000)
+		chars     -> 'A', '\n', '\t', '\0', '\\', '\''
+		names     -> constants declared with .equ, or labels, which are their index (or data address in .data)
+		operators -> + - * / % and ( ), with - and + also allowed in front of a value
+	* / and % bind tighter than + and -, division rounds towards zero like the VM's DIV.
+*/
+func (lexer *Lexer) Evaluate(text string) (int64, []string, error) {
+	expr := expression{lexer: lexer, text: text}
+	value, err := expr.parseSum()
+	if err == nil && expr.pos < len(expr.text) {
+		err = fmt.Errorf("unexpected '%c' in '%s'", expr.text[expr.pos], text)
+	}
+	return value, expr.unresolved, err
+}
+
+// Check if a token should be read as an expression rather than a label or command: it starts like a number, a char
+// or a sign, contains an operator, or is a constant
+func (lexer *Lexer) IsExpression(token string) bool {
+	if _, ok := lexer.Constants[token]; ok {
+		return true
+	}
+	switch token[0] {
+	case '\'', '(', '-', '+':
+		return true
+	}
+	if token[0] >= '0' && token[0] <= '9' {
+		return true
+	}
+	return token[0] != '"' && token[0] != '[' && strings.ContainsAny(token, "+-*/%()")
+}
+
+// Check if an expression uses any labels
+func (lexer *Lexer) ExpressionUsesLabel(text string) bool {
+	expr := expression{lexer: lexer, text: text}
+	expr.parseSum()
+	return expr.labels
+}
+
+func (expr *expression) peek() byte {
+	if expr.pos < len(expr.text) {
+		return expr.text[expr.pos]
+	}
+	return 0
+}
+
+func (expr *expression) parseSum() (int64, error) {
+	value, err := expr.parseProduct()
+	for err == nil && (expr.peek() == '+' || expr.peek() == '-') {
+		op := expr.peek()
+		expr.pos++
+		var rhs int64
+		if rhs, err = expr.parseProduct(); err != nil {
+			break
+		}
+		if op == '+' {
+			value += rhs
+		} else {
+			value -= rhs
+		}
+		err = expr.checkRange(value)
+	}
+	return value, err
+}
+
+func (expr *expression) parseProduct() (int64, error) {
+	value, err := expr.parseUnary()
+	for err == nil && (expr.peek() == '*' || expr.peek() == '/' || expr.peek() == '%') {
+		op := expr.peek()
+		expr.pos++
+		var rhs int64
+		if rhs, err = expr.parseUnary(); err != nil {
+			break
+		}
+		switch op {
+		case '*':
+			value *= rhs
+		case '/', '%':
+			if rhs == 0 {
+				if len(expr.unresolved) > 0 { // Let the fixup report it once the labels are known
+					value = 0
+					continue
+				}
+				return 0, fmt.Errorf("division by zero in '%s'", expr.text)
+			}
+			if op == '/' {
+				value /= rhs
+			} else {
+				value %= rhs
+			}
+		}
+		err = expr.checkRange(value)
+	}
+	return value, err
+}
+
+func (expr *expression) parseUnary() (int64, error) {
+	switch expr.peek() {
+	case '-':
+		expr.pos++
+		value, err := expr.parseUnary()
+		return -value, err
+	case '+':
+		expr.pos++
+		return expr.parseUnary()
+	}
+	return expr.parseValue()
+}
+
+func (expr *expression) parseValue() (int64, error) {
+	start := expr.pos
+	char := expr.peek()
+	switch {
+	case char == 0:
+		return 0, fmt.Errorf("'%s' is missing a value at its end", expr.text)
+	case char == '(':
+		expr.pos++
+		value, err := expr.parseSum()
+		if err != nil {
+			return 0, err
+		}
+		if expr.peek() != ')' {
+			return 0, fmt.Errorf("'%s' is missing a closing ')'", expr.text)
+		}
+		expr.pos++
+		return value, nil
+	case char == '\'':
+		value, _, tail, err := strconv.UnquoteChar(expr.text[expr.pos+1:], '\'')
+		if err != nil || !strings.HasPrefix(tail, "'") {
+			return 0, fmt.Errorf("invalid char literal in '%s'", expr.text)
+		}
+		expr.pos = len(expr.text) - len(tail) + 1
+		return int64(value), nil
+	case char >= '0' && char <= '9':
+		for expr.pos < len(expr.text) && IsNameChar(expr.text[expr.pos]) {
+			expr.pos++
+		}
+		return ParseNumber(expr.text[start:expr.pos])
+	case IsNameChar(char):
+		for expr.pos < len(expr.text) && IsNameChar(expr.text[expr.pos]) {
+			expr.pos++
+		}
+		return expr.lookupName(expr.text[start:expr.pos])
+	}
+	return 0, fmt.Errorf("unexpected '%c' in '%s'", char, expr.text)
+}
+
+// Look up a constant or label, labels that haven't been declared yet count as 0 and are noted as unresolved
+func (expr *expression) lookupName(name string) (int64, error) {
+	if IsRegisterName(name) {
+		return 0, fmt.Errorf("register '%s' cannot be used in an expression", name)
+	}
+	if value, ok := expr.lexer.Constants[name]; ok {
+		return int64(value), nil
+	}
+	expr.labels = true
+	if index, ok := expr.lexer.LabelToIndex[name]; ok {
+		return int64(index), nil
+	}
+	if expr.lexer.Externs[name] {
+		return 0, nil // Filled in by the linker
+	}
+	if _, _, isCommand := LookupCommand(name); isCommand {
+		return 0, fmt.Errorf("command '%s' cannot be used in an expression", name)
+	}
+	expr.unresolved = append(expr.unresolved, name)
+	return 0, nil
+}
+
+func (expr *expression) checkRange(value int64) error {
+	if value > maxExpressionValue || value < -maxExpressionValue {
+		return fmt.Errorf("'%s' is out of range", expr.text)
+	}
+	return nil
+}
+
+// ParseNumber function
+/*
+	Read a number in decimal, or in hex, binary or octal with a 0x, 0b or 0o prefix. '_' may separate digits.
+*/
+func ParseNumber(text string) (int64, error) {
+	digits := strings.ToLower(text)
+	base := 10
+	switch {
+	case strings.HasPrefix(digits, "0x"):
+		base, digits = 16, digits[2:]
+	case strings.HasPrefix(digits, "0b"):
+		base, digits = 2, digits[2:]
+	case strings.HasPrefix(digits, "0o"):
+		base, digits = 8, digits[2:]
+	}
+	if digits == "" || digits[0] == '_' || digits[len(digits)-1] == '_' || strings.Contains(digits, "__") {
+		return 0, fmt.Errorf("invalid number '%s'", text)
+	}
+	value, err := strconv.ParseInt(strings.ReplaceAll(digits, "_", ""), base, 64)
+	if errors.Is(err, strconv.ErrRange) || value > maxExpressionValue {
+		return 0, fmt.Errorf("number '%s' does not fit in 32 bits", text)
+	} else if err != nil {
+		return 0, fmt.Errorf("invalid number '%s'", text)
+	}
+	return value, nil
+}
+
+func IsNameChar(char byte) bool {
+	return char == '_' || (char >= 'A' && char <= 'Z') || (char >= 'a' && char <= 'z') || (char >= '0' && char <= '9')
+}
+
+// Check a value fits in an int32, for data words and constants
+func CheckInt32(text string, value int64) error {
+	if value > math.MaxInt32 || value < math.MinInt32 {
+		return fmt.Errorf("value of '%s' (%d) does not fit in 32 bits", text, value)
+	}
+	return nil
+}
+
+// Patch every value that used a label declared further down, now that all labels are known
+func (lexer *Lexer) ApplyFixups(lexemes []uint32) {
+	for _, fixup := range lexer.Fixups {
+		value, unresolved, err := lexer.Evaluate(fixup.Expression)
+		if len(unresolved) > 0 {
+			continue // Reported as an unresolved label
+		}
+		if err == nil {
+			if fixup.InData || fixup.Wide {
+				err = CheckInt32(fixup.Expression, value)
+			} else if value > 1073741823 || value < -1073741823 {
+				// The parameter was given a single word before the label was known
+				err = fmt.Errorf("value of '%s' (%d) uses a label declared after it, so it must fit in 30 bits", fixup.Expression, value)
+			}
+		}
+		if err != nil {
+			lexer.Errorf(fixup.Position, "%s", err.Error())
+			continue
+		}
+		if fixup.InData {
+			lexer.Data[fixup.Index] = int32(value)
+		} else if fixup.Wide {
+			lexemes[fixup.Index+1] = uint32(int32(value))
+		} else {
+			lexemes[fixup.Index] = uint32(value & 0xBFFFFFFF)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package palexer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseNumber(t *testing.T) {
+	cases := []struct {
+		text  string
+		value int64
+		err   string
+	}{
+		{"42", 42, ""},
+		{"0x1F", 31, ""},
+		{"0XFF", 255, ""},
+		{"0b1010", 10, ""},
+		{"0o17", 15, ""},
+		{"1_000_000", 1000000, ""},
+		{"0xFFFF_FFFF", 4294967295, ""},
+		{"0x", 0, "invalid number"},
+		{"1__0", 0, "invalid number"},
+		{"10_", 0, "invalid number"},
+		{"0x_1", 0, "invalid number"},
+		{"0b102", 0, "invalid number"},
+		{"12abc", 0, "invalid number"},
+		{"0x7FFFFFFFFFFFFFFFFF", 0, "does not fit in 32 bits"},
+	}
+	for _, c := range cases {
+		value, err := ParseNumber(c.text)
+		if c.err == "" && (err != nil || value != c.value) {
+			t.Errorf("ParseNumber(%q) = %d, %v, expected %d", c.text, value, err, c.value)
+		} else if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("ParseNumber(%q) = %d, %v, expected an error containing %q", c.text, value, err, c.err)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	lexer := &Lexer{
+		Constants:    map[string]int32{"SIZE": 10},
+		LabelToIndex: map[string]int{"LABEL": 7},
+		Externs:      map[string]bool{},
+	}
+	cases := []struct {
+		text       string
+		value      int64
+		unresolved string
+		err        string
+	}{
+		{"1+2*3", 7, "", ""},
+		{"(1+2)*3", 9, "", ""},
+		{"10-4-3", 3, "", ""},
+		{"100/10/5", 2, "", ""},
+		{"-7/2", -3, "", ""},
+		{"-7%3", -1, "", ""},
+		{"--5", 5, "", ""},
+		{"+5-+2", 3, "", ""},
+		{"'A'", 65, "", ""},
+		{"'\\n'+1", 11, "", ""},
+		{"'\\''", 39, "", ""},
+		{"SIZE*2", 20, "", ""},
+		{"LABEL+2", 9, "", ""},
+		{"LABEL-SIZE", -3, "", ""},
+		{"later+2", 2, "later", ""}, // Counts as 0 until it is declared
+		{"1/later", 0, "later", ""},
+		{"1/0", 0, "", "division by zero"},
+		{"(1+2", 0, "", "missing a closing ')'"},
+		{"1+", 0, "", "missing a value"},
+		{"1)", 0, "", "unexpected ')'"},
+		{"R1+1", 0, "", "register 'R1' cannot be used"},
+		{"ADD+1", 0, "", "command 'ADD' cannot be used"},
+		{"'ab'", 0, "", "invalid char literal"},
+		{"0x10000000000*2", 0, "", "out of range"},
+	}
+	for _, c := range cases {
+		value, unresolved, err := lexer.Evaluate(c.text)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("Evaluate(%q) = %d, %v, expected an error containing %q", c.text, value, err, c.err)
+			}
+			continue
+		}
+		if err != nil || value != c.value || strings.Join(unresolved, ",") != c.unresolved {
+			t.Errorf("Evaluate(%q) = %d, %v, %v, expected %d unresolved [%s]", c.text, value, unresolved, err, c.value, c.unresolved)
+		}
+	}
+}
+
+func TestExpressionDiagnostics(t *testing.T) {
+	cases := []struct {
+		src string
+		err string
+	}{
+		{"MOV R1 0x1_0000_0000", "does not fit in 32 bits"},
+		{".data\n.word 2147483648", "does not fit in 32 bits"},
+		{"MOV R1 later+1073741823\nlater:", "must fit in 30 bits"},
+		{"MOV R1 2147483000+later*1000\nlater:", "does not fit in 32 bits"},
+		{".data\n.word later*0x80000000\n.text\nHALT\nlater:", "does not fit in 32 bits"},
+		{"MOV R1 1/(later-later)\nlater:", "division by zero"},
+	}
+	for _, c := range cases {
+		_, diagnostics, err := Assemble(c.src)
+		if err == nil || len(diagnostics) != 1 || !strings.Contains(diagnostics[0].Message, c.err) {
+			t.Errorf("%q: expected a single error containing %q, got %v", c.src, c.err, diagnostics)
+		}
+	}
+}
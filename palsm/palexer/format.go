@@ -0,0 +1,79 @@
+package palexer
+
+import (
+	"fmt"
+	palsm "palsm/palsm_h"
+)
+
+// Format a single word the way it would be written in a .palsm file
+/*
+	The two most significant bits of a word give its type:
+		0 -> positive int
+		1 -> op code
+		2 -> negative int
+		3 -> register, or an indirect address when bit 29 is set
+*/
+func FormatWord(word uint32) string {
+	data := word & 0x3FFFFFFF
+	switch word >> 30 {
+	case 0:
+		return fmt.Sprintf("%d", data)
+	case 1:
+		if command, ok := LookupOpCode(word); ok {
+			return command.Name
+		}
+		return fmt.Sprintf("<op 0x%08X>", word)
+	case 2:
+		return fmt.Sprintf("%d", int32(data|0xC0000000))
+	}
+	if data&0x20000000 != 0 {
+		offset := int32(data<<3) >> 7
+		if offset == 0 {
+			return fmt.Sprintf("[R%d]", data&0xF+1)
+		}
+		return fmt.Sprintf("[R%d%+d]", data&0xF+1, offset)
+	}
+	return fmt.Sprintf("R%d", data+1)
+}
+
+// Format the instruction whose words are given, operands first and op code last as the lexer lays them out,
+// as "COMMAND operand operand"
+func FormatInstruction(words []uint32) string {
+	if len(words) == 0 {
+		return ""
+	}
+	text := FormatWord(words[len(words)-1])
+	for i := 0; i < len(words)-1; i++ {
+		if words[i] == palsm.WideImmediate && i+1 < len(words)-1 {
+			i++
+			text += fmt.Sprintf(" %d", int32(words[i]))
+			continue
+		}
+		text += " " + FormatWord(words[i])
+	}
+	return text
+}
+
+// Find the index of the op code that ends the instruction starting at start, skipping over the raw word after a
+// palsm.WideImmediate. Returns the last index and false if the words run out before an op code.
+func InstructionEnd(words []uint32, start int) (int, bool) {
+	for i := start; i < len(words); i++ {
+		if words[i] == palsm.WideImmediate {
+			i++
+		} else if words[i]>>30 == 1 {
+			return i, true
+		}
+	}
+	return len(words) - 1, false
+}
+
+// Find the index of the first word of every instruction, an instruction ends at its op code word
+func InstructionStarts(words []uint32) []int {
+	var starts []int
+	for start := 0; start < len(words); {
+		starts = append(starts, start)
+		end, _ := InstructionEnd(words, start)
+		start = end + 1
+	}
+	return starts
+}
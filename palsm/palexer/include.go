@@ -0,0 +1,88 @@
+package palexer
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Option configures the lexer when assembling with AssembleFile
+type Option func(*Lexer)
+
+// WithIncludeDirs adds directories searched for .include files not found next to the file including them
+func WithIncludeDirs(dirs ...string) Option {
+	return func(lexer *Lexer) {
+		lexer.IncludeDirs = append(lexer.IncludeDirs, dirs...)
+	}
+}
+
+// Include function
+/*
+	Paste in the lines of the file named by .include "path". The path is looked for relative to the directory of the
+	file including it, then in each of lexer.IncludeDirs in order. A file that has a .once line is only pasted in the
+	first time it is included, and a file that ends up including itself is reported as an include cycle.
+*/
+func (lexer *Lexer) Include(fields []string, origin Origin, depth int) []SourceLine {
+	if len(fields) != 1 {
+		lexer.ErrorAt(origin, 1, "'.include' was expecting a single \"path\"")
+		return nil
+	}
+	name, err := strconv.Unquote(fields[0])
+	if fields[0][0] != '"' || err != nil || name == "" {
+		lexer.ErrorAt(origin, 1, "invalid include path %s", fields[0])
+		return nil
+	}
+
+	path, src, ok := lexer.FindInclude(name, filepath.Dir(origin.File))
+	if !ok {
+		searched := append([]string{filepath.Dir(origin.File)}, lexer.IncludeDirs...)
+		lexer.ErrorAt(origin, 1, "cannot find included file '%s' (searched %s)", name, strings.Join(searched, ", "))
+		return nil
+	}
+	key := IncludeKey(path)
+	if lexer.OnceFiles[key] {
+		return nil
+	}
+	for i, including := range lexer.Including {
+		if including == key {
+			chain := append(append([]string{}, lexer.Including[i:]...), key)
+			lexer.ErrorAt(origin, 1, "include cycle: %s", strings.Join(chain, " -> "))
+			return nil
+		}
+	}
+
+	var lines []SourceLine
+	for i, text := range strings.Split(src, "\n") {
+		lines = append(lines, SourceLine{Text: strings.TrimSuffix(text, "\r"), Origin: Origin{File: path, Line: i + 1}})
+	}
+	lexer.Including = append(lexer.Including, key)
+	lines = lexer.ExpandLines(lines, depth)
+	lexer.Including = lexer.Including[:len(lexer.Including)-1]
+	return lines
+}
+
+// Look for an included file in dir and then the include directories, returning the path it was found at
+func (lexer *Lexer) FindInclude(name string, dir string) (string, string, bool) {
+	candidates := []string{name}
+	if !filepath.IsAbs(name) {
+		candidates = []string{filepath.Join(dir, name)}
+		for _, includeDir := range lexer.IncludeDirs {
+			candidates = append(candidates, filepath.Join(includeDir, name))
+		}
+	}
+	for _, candidate := range candidates {
+		if src, err := os.ReadFile(candidate); err == nil {
+			return candidate, string(src), true
+		}
+	}
+	return "", "", false
+}
+
+// The name a file is known by for include cycles and .once, the same file reached by two paths has the same key
+func IncludeKey(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
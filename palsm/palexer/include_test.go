@@ -0,0 +1,130 @@
+package palexer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write files into a new temporary directory, returning it
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestIncludeSearchOrder(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"src/main.palsm":     ".include \"value.palsm\"\n.include \"other.palsm\"\nMOV R1 VALUE+OTHER",
+		"src/value.palsm":    ".equ VALUE 1",
+		"first/value.palsm":  ".equ VALUE 100",
+		"first/other.palsm":  ".equ OTHER 20",
+		"second/other.palsm": ".equ OTHER 300",
+	})
+	main := filepath.Join(dir, "src", "main.palsm")
+	src, _ := os.ReadFile(main)
+
+	// Next to the including file first, then each -I directory in order
+	program, diagnostics, err := AssembleFile(main, string(src), WithIncludeDirs(filepath.Join(dir, "first"), filepath.Join(dir, "second")))
+	if err != nil {
+		t.Fatalf("assembling: %v", diagnostics)
+	}
+	if program.Code[1] != 21 {
+		t.Errorf("VALUE+OTHER is %d, expected 21", program.Code[1])
+	}
+
+	program, diagnostics, err = AssembleFile(main, string(src), WithIncludeDirs(filepath.Join(dir, "second"), filepath.Join(dir, "first")))
+	if err != nil {
+		t.Fatalf("assembling: %v", diagnostics)
+	}
+	if program.Code[1] != 301 {
+		t.Errorf("VALUE+OTHER is %d, expected 301", program.Code[1])
+	}
+
+	// other.palsm is only found through -I
+	_, diagnostics, err = AssembleFile(main, string(src))
+	if err == nil || len(diagnostics) == 0 || !strings.Contains(diagnostics[0].Message, "cannot find included file 'other.palsm'") {
+		t.Errorf("unexpected diagnostics %v", diagnostics)
+	}
+}
+
+func TestIncludedDiagnosticLocation(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.palsm":     "MOV R1 1\n.include \"included.palsm\"\nOUT R1",
+		"included.palsm": strings.Repeat("// line\n", 11) + "  ADD R1 R99\n",
+	})
+	main := filepath.Join(dir, "main.palsm")
+	src, _ := os.ReadFile(main)
+	_, diagnostics, err := AssembleFile(main, string(src))
+	if err == nil || len(diagnostics) != 1 {
+		t.Fatalf("unexpected diagnostics %v", diagnostics)
+	}
+	expected := filepath.Join(dir, "included.palsm") + ":12:"
+	if !strings.HasPrefix(diagnostics[0].String(), expected) {
+		t.Errorf("got %q, expected it at %s", diagnostics[0].String(), expected)
+	}
+}
+
+func TestIncludeCycle(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.palsm": ".include \"b.palsm\"\nHALT",
+		"b.palsm": ".include \"c.palsm\"",
+		"c.palsm": ".include \"b.palsm\"",
+	})
+	main := filepath.Join(dir, "a.palsm")
+	src, _ := os.ReadFile(main)
+	_, diagnostics, err := AssembleFile(main, string(src))
+	if err == nil || len(diagnostics) != 1 {
+		t.Fatalf("unexpected diagnostics %v", diagnostics)
+	}
+	b, c := filepath.Join(dir, "b.palsm"), filepath.Join(dir, "c.palsm")
+	expected := "include cycle: " + b + " -> " + c + " -> " + b
+	if diagnostics[0].Message != expected || diagnostics[0].File != c || diagnostics[0].Line != 1 {
+		t.Errorf("got %v, expected %q at %s:1", diagnostics[0], expected, c)
+	}
+
+	// Including itself is a cycle too
+	dir = writeFiles(t, map[string]string{"self.palsm": "HALT\n.include \"self.palsm\""})
+	main = filepath.Join(dir, "self.palsm")
+	src, _ = os.ReadFile(main)
+	if _, diagnostics, err := AssembleFile(main, string(src)); err == nil || !strings.Contains(diagnostics[0].Message, "include cycle") {
+		t.Errorf("unexpected diagnostics %v", diagnostics)
+	}
+}
+
+func TestIncludeOnce(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.palsm":   ".include \"once.palsm\"\n.include \"twice.palsm\"\n.include \"sub/../once.palsm\"\n.include \"twice.palsm\"",
+		"once.palsm":   ".once\nOUT 1",
+		"twice.palsm":  "OUT 2",
+		"sub/x.palsm":  "",
+		"header.palsm": ".once\n.include \"header.palsm\"",
+	})
+	main := filepath.Join(dir, "main.palsm")
+	src, _ := os.ReadFile(main)
+	program, diagnostics, err := AssembleFile(main, string(src))
+	if err != nil {
+		t.Fatalf("assembling: %v", diagnostics)
+	}
+	// OUT 1, OUT 2, OUT 2 and the HALT, the same file reached by another path is still only included once
+	if len(program.Code) != 7 {
+		t.Errorf("unexpected code %08X", program.Code)
+	}
+
+	// A .once file including itself is not a cycle, it is already marked as included
+	main = filepath.Join(dir, "header.palsm")
+	src, _ = os.ReadFile(main)
+	if _, diagnostics, err := AssembleFile(main, string(src)); err != nil {
+		t.Errorf("unexpected diagnostics %v", diagnostics)
+	}
+}
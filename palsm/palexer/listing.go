@@ -0,0 +1,171 @@
+package palexer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Span is a run of words in the code or the data, and where in the preprocessed source they were assembled from
+type Span struct {
+	Addr     int
+	Size     int
+	InData   bool
+	Position Position // Line is a line of Program.Source
+}
+
+// Most words shown on a single row of a listing, longer runs carry on onto the rows below
+const listingWords = 4
+
+// Record the words from start up to the end of the code or data as assembled from the source at position
+func (lexer *Lexer) AddSpan(start int, position Position, inData bool) {
+	end := lexer.LexemesIndex
+	if inData {
+		end = len(lexer.Data)
+	}
+	if end > start {
+		lexer.Spans = append(lexer.Spans, Span{Addr: start, Size: end - start, InData: inData, Position: position})
+	}
+}
+
+// Origin gives the file and line a position in the preprocessed source came from
+func (program Program) Origin(position Position) Origin {
+	if position.Line >= 1 && position.Line <= len(program.Source) {
+		return program.Source[position.Line-1].Origin
+	}
+	return Origin{Line: position.Line}
+}
+
+// Listing function
+/*
+	Lay out every line of the source along with the address and words it assembled to, as such:
+		ADDR    WORDS                                LINE           SOURCE
+		0x0000  C0000000 00000005 4000000A           loop.palsm:3   MOV R1 5
+		D0x0000 00000068 00000069 00000000           loop.palsm:9   msg: .string "hi"
+	Operands come before the op code, as the lexer lays them out. Addresses in the data are marked with a D. Lines
+	pasted in by .include and macros are listed where they end up, after the line that pasted them in, and macro lines
+	show the macro they came from. Macro definitions are listed where they were written, without any words.
+*/
+func (program Program) Listing() string {
+	spans := make(map[int][]Span)
+	for _, span := range program.Spans {
+		spans[span.Position.Line] = append(spans[span.Position.Line], span)
+	}
+
+	locations := make([]string, len(program.Source))
+	width := len("LINE")
+	for i, line := range program.Source {
+		locations[i] = fmt.Sprintf("%s:%d", listingFile(line.Origin.File), line.Origin.Line)
+		if line.Origin.Macro != "" {
+			locations[i] += " (" + line.Origin.Macro + ")"
+		}
+		if len(locations[i]) > width {
+			width = len(locations[i])
+		}
+	}
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "%-7s %-36s %-*s  %s\n", "ADDR", "WORDS", width, "LINE", "SOURCE")
+	for i, line := range program.Source {
+		text := line.Text
+		if line.Original != "" {
+			text = line.Original
+		}
+		text = strings.TrimRight(text, " \t")
+
+		var rows []string
+		for _, span := range spans[i+1] {
+			rows = append(rows, program.listingRows(span)...)
+		}
+		if len(rows) == 0 {
+			rows = []string{fmt.Sprintf("%-7s %-36s", "", "")}
+		}
+		for j, row := range rows {
+			if j == 0 {
+				row = fmt.Sprintf("%s %-*s  %s", row, width, locations[i], text)
+			}
+			builder.WriteString(strings.TrimRight(row, " ") + "\n")
+		}
+	}
+
+	// The lexer ends every program with a HALT of its own
+	if end := len(program.Code) - 1; end >= 0 && (len(program.Spans) == 0 || program.lastCodeWord() < end) {
+		fmt.Fprintf(&builder, "0x%04X  %-36s %-*s  %s\n", end, fmt.Sprintf("%08X", program.Code[end]), width, "", "(end of program)")
+	}
+	return builder.String()
+}
+
+// Format the words of a span, listingWords to a row, with the address of the first word of each row in front
+func (program Program) listingRows(span Span) []string {
+	var rows []string
+	for start := span.Addr; start < span.Addr+span.Size; start += listingWords {
+		end := start + listingWords
+		if end > span.Addr+span.Size {
+			end = span.Addr + span.Size
+		}
+		var words []string
+		for addr := start; addr < end; addr++ {
+			if span.InData {
+				words = append(words, fmt.Sprintf("%08X", uint32(program.Data[addr])))
+			} else {
+				words = append(words, fmt.Sprintf("%08X", program.Code[addr]))
+			}
+		}
+		address := fmt.Sprintf("0x%04X", start)
+		if span.InData {
+			address = "D" + address
+		}
+		rows = append(rows, fmt.Sprintf("%-7s %-36s", address, strings.Join(words, " ")))
+	}
+	return rows
+}
+
+// Index of the last word in the code that came from the source
+func (program Program) lastCodeWord() int {
+	last := -1
+	for _, span := range program.Spans {
+		if !span.InData && span.Addr+span.Size-1 > last {
+			last = span.Addr + span.Size - 1
+		}
+	}
+	return last
+}
+
+func listingFile(file string) string {
+	if file == "" {
+		return "<input>"
+	}
+	return file
+}
+
+// SymbolMap function
+/*
+	List every label with its final address, first sorted by name and then by address, code before data.
+*/
+func (program Program) SymbolMap() string {
+	symbols := program.Image().Symbols // Sorted by name
+	var builder strings.Builder
+	builder.WriteString("Labels by name:\n")
+	for _, symbol := range symbols {
+		fmt.Fprintf(&builder, "  %-24s %s\n", symbol.Name, program.mapAddress(symbol.Name))
+	}
+
+	sort.SliceStable(symbols, func(i, j int) bool {
+		if symbols[i].Section != symbols[j].Section {
+			return symbols[i].Section < symbols[j].Section
+		}
+		return symbols[i].Value < symbols[j].Value
+	})
+	builder.WriteString("\nLabels by address:\n")
+	for _, symbol := range symbols {
+		fmt.Fprintf(&builder, "  %-11s %s\n", program.mapAddress(symbol.Name), symbol.Name)
+	}
+	return builder.String()
+}
+
+func (program Program) mapAddress(label string) string {
+	if program.InData[label] {
+		return fmt.Sprintf("data 0x%04X", program.Labels[label])
+	}
+	return fmt.Sprintf("code 0x%04X", program.Labels[label])
+}
@@ -0,0 +1,330 @@
+package palexer
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Deepest a macro may invoke other macros
+const MaxMacroDepth = 64
+
+// Most macro expansions in one program, which stops macros that each invoke the next several times from blowing up
+const MaxMacroExpansions = 100000
+
+// Origin is where a line of the preprocessed source came from
+type Origin struct {
+	File   string
+	Line   int
+	Macro  string  // Name of the macro the line is part of, empty outside of macros
+	Caller *Origin // The line the macro was invoked on
+}
+
+// Macro is a block of lines defined with .macro and .endm, pasted in wherever its name is used as a command
+type Macro struct {
+	Name   string
+	Params []string
+	Body   []SourceLine
+	Labels map[string]bool // Labels declared in the body, given a unique name in every expansion
+	Origin Origin          // The line of the .macro directive
+}
+
+// SourceLine is a single line of source along with where it came from
+type SourceLine struct {
+	Text     string
+	Origin   Origin
+	Original string // The line as written when Preprocess took it out and left Text empty, for the listing
+}
+
+// Preprocess function
+/*
+	Expand the macros in the source before it is lexed, recording where every line of the result came from in
+	lexer.Lines so diagnostics point back at the line that was written. A macro looks as such:
+		.macro COUNT reg, limit
+		again:
+			ADD reg 1
+			LT reg limit
+			JMPF again
+		.endm
+	and is used like a command, COUNT R1, 10 (or COUNT R1 10). Its parameters are replaced by the arguments
+	wherever they appear as a name, and the labels declared in it are renamed in each expansion so they don't collide.
+	The lines taken out, the definitions, invocations and .include lines, are left in as empty lines that keep their
+	original text so the listing still shows them.
+	A macro has to be defined before it is used, and can use other macros up to MaxMacroDepth deep. A macro that
+	ends up invoking itself is an error, and no more than MaxMacroExpansions expansions are made in all.
+	.include lines are replaced by the file they name here too, see Include.
+*/
+func (lexer *Lexer) Preprocess(src string) string {
+	lexer.Macros = make(map[string]*Macro)
+	lexer.OnceFiles = make(map[string]bool)
+	if lexer.File != "" {
+		lexer.Including = []string{IncludeKey(lexer.File)}
+	}
+	var lines []SourceLine
+	for i, text := range strings.Split(src, "\n") {
+		lines = append(lines, SourceLine{Text: strings.TrimSuffix(text, "\r"), Origin: Origin{File: lexer.File, Line: i + 1}})
+	}
+	lines = lexer.ExpandLines(lines, 0)
+	lexer.Source = lines
+
+	texts := make([]string, len(lines))
+	lexer.Lines = make([]Origin, len(lines))
+	for i, line := range lines {
+		texts[i] = line.Text
+		lexer.Lines[i] = line.Origin
+	}
+	return strings.Join(texts, "\n")
+}
+
+// Collect macro definitions and expand macro invocations in lines, depth is how many macros deep they are
+func (lexer *Lexer) ExpandLines(lines []SourceLine, depth int) []SourceLine {
+	var out []SourceLine
+	var macro *Macro
+	define := false // Set if the macro being defined has a usable name
+	inComment := false
+	for _, line := range lines {
+		var code string
+		code, inComment = StripComment(line.Text, inComment)
+		fields := SplitFields(code)
+		takenOut := SourceLine{Origin: line.Origin, Original: line.Text}
+
+		if macro != nil { // Inside a definition
+			if len(fields) > 0 && fields[0] == ".endm" {
+				if define {
+					lexer.Macros[macro.Name] = macro
+				}
+				macro = nil
+			} else if len(fields) > 0 && fields[0] == ".macro" {
+				lexer.ErrorAt(line.Origin, 1, "macro '%s' cannot be defined inside macro '%s'", strings.Join(fields[1:2], ""), macro.Name)
+			} else {
+				for _, field := range fields {
+					if strings.HasSuffix(field, ":") && OpenQuote(field) == 0 {
+						macro.Labels[strings.TrimSuffix(field, ":")] = true
+					}
+				}
+				macro.Body = append(macro.Body, line)
+			}
+			out = append(out, takenOut)
+			continue
+		}
+
+		if len(fields) > 0 && fields[0] == ".macro" {
+			macro, define = lexer.DefineMacro(fields[1:], line.Origin)
+			out = append(out, takenOut)
+			continue
+		} else if len(fields) > 0 && fields[0] == ".endm" {
+			lexer.ErrorAt(line.Origin, 1, "'.endm' without a '.macro'")
+			out = append(out, takenOut)
+			continue
+		} else if len(fields) > 0 && fields[0] == ".include" {
+			out = append(out, takenOut)
+			out = append(out, lexer.Include(fields[1:], line.Origin, depth)...)
+			continue
+		} else if len(fields) > 0 && fields[0] == ".once" {
+			lexer.OnceFiles[IncludeKey(line.Origin.File)] = true
+			out = append(out, takenOut)
+			continue
+		}
+
+		// An invocation may have labels in front of it
+		i := 0
+		for i < len(fields) && strings.HasSuffix(fields[i], ":") {
+			i++
+		}
+		name := ""
+		if i < len(fields) {
+			name = fields[i]
+		}
+		invoked, ok := lexer.Macros[name]
+		if !ok {
+			out = append(out, line)
+			continue
+		}
+		if i > 0 { // The labels stay on the line of the invocation
+			takenOut.Text = strings.Join(fields[:i], " ")
+		}
+		out = append(out, takenOut)
+		var args []string
+		for _, field := range fields[i+1:] {
+			for _, arg := range SplitValues(field) {
+				if arg != "" {
+					args = append(args, arg)
+				}
+			}
+		}
+		out = append(out, lexer.ExpandMacro(invoked, args, line.Origin, depth)...)
+	}
+	if macro != nil {
+		lexer.ErrorAt(macro.Origin, 1, "macro '%s' is missing its '.endm'", macro.Name)
+	}
+	return out
+}
+
+// Start the definition of a macro from the fields after .macro, its name followed by its parameters.
+// Returns false if the name can't be used, the body is still read so it can be skipped.
+func (lexer *Lexer) DefineMacro(fields []string, origin Origin) (*Macro, bool) {
+	var names []string
+	for _, field := range fields {
+		for _, name := range strings.Split(field, ",") {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		lexer.ErrorAt(origin, 1, "'.macro' was expecting a name")
+		return &Macro{Labels: make(map[string]bool), Origin: origin}, false
+	}
+
+	macro := &Macro{Name: names[0], Params: names[1:], Labels: make(map[string]bool), Origin: origin}
+	isName := regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+	define := false
+	if _, _, isCommand := LookupCommand(macro.Name); isCommand || IsRegisterName(macro.Name) {
+		lexer.ErrorAt(origin, 1, "macro name '%s' is already a command or register", macro.Name)
+	} else if !isName.MatchString(macro.Name) {
+		lexer.ErrorAt(origin, 1, "invalid macro name '%s'", macro.Name)
+	} else if _, ok := lexer.Macros[macro.Name]; ok {
+		lexer.ErrorAt(origin, 1, "macro '%s' is defined more than once", macro.Name)
+	} else {
+		define = true
+	}
+	seen := make(map[string]bool)
+	for _, param := range macro.Params {
+		if !isName.MatchString(param) || IsRegisterName(param) {
+			lexer.ErrorAt(origin, 1, "invalid parameter name '%s' for macro '%s'", param, macro.Name)
+		} else if seen[param] {
+			lexer.ErrorAt(origin, 1, "parameter '%s' of macro '%s' is declared more than once", param, macro.Name)
+		}
+		seen[param] = true
+	}
+	return macro, define
+}
+
+// Paste in the body of a macro, substituting its arguments and giving its labels names unique to this expansion
+func (lexer *Lexer) ExpandMacro(macro *Macro, args []string, caller Origin, depth int) []SourceLine {
+	if len(args) != len(macro.Params) {
+		lexer.ErrorAt(caller, 1, "macro '%s' expects %d argument(s), received %d", macro.Name, len(macro.Params), len(args))
+		return nil
+	}
+	for origin := &caller; origin != nil; origin = origin.Caller {
+		if origin.Macro == macro.Name {
+			lexer.ErrorAt(caller, 1, "macro '%s' invokes itself", macro.Name)
+			return nil
+		}
+	}
+	if depth >= MaxMacroDepth {
+		lexer.ErrorAt(caller, 1, "macro '%s' is nested more than %d deep", macro.Name, MaxMacroDepth)
+		return nil
+	}
+	if lexer.Expansions >= MaxMacroExpansions {
+		if lexer.Expansions == MaxMacroExpansions { // Only reported the first time
+			lexer.ErrorAt(caller, 1, "more than %d macro expansions, stopped expanding at macro '%s'", MaxMacroExpansions, macro.Name)
+		}
+		lexer.Expansions++
+		return nil
+	}
+
+	lexer.Expansions++
+	names := make(map[string]string)
+	for label := range macro.Labels {
+		names[label] = fmt.Sprintf("%s__%d", label, lexer.Expansions)
+	}
+	for i, param := range macro.Params {
+		names[param] = args[i]
+	}
+
+	lines := make([]SourceLine, len(macro.Body))
+	for i, line := range macro.Body {
+		origin := line.Origin
+		origin.Macro = macro.Name
+		origin.Caller = &caller
+		lines[i] = SourceLine{Text: SubstituteNames(line.Text, names), Origin: origin}
+	}
+	return lexer.ExpandLines(lines, depth+1)
+}
+
+// Replace every name in text found in names, leaving strings, chars, numbers and comments alone
+func SubstituteNames(text string, names map[string]string) string {
+	var builder strings.Builder
+	for i := 0; i < len(text); {
+		char := text[i]
+		switch {
+		case char == '"' || char == '\'':
+			end := i + 1
+			for end <= len(text) && OpenQuote(text[i:end]) != 0 {
+				end++
+			}
+			if end > len(text) {
+				end = len(text)
+			}
+			builder.WriteString(text[i:end])
+			i = end
+		case strings.HasPrefix(text[i:], "//"):
+			builder.WriteString(text[i:])
+			i = len(text)
+		case IsNameChar(char):
+			end := i
+			for end < len(text) && IsNameChar(text[end]) {
+				end++
+			}
+			name := text[i:end]
+			if replacement, ok := names[name]; ok && !(char >= '0' && char <= '9') {
+				name = replacement
+			}
+			builder.WriteString(name)
+			i = end
+		default:
+			builder.WriteByte(char)
+			i++
+		}
+	}
+	return builder.String()
+}
+
+// Cut the comments out of a line, inComment is set if the line starts inside a /* */ comment.
+// Returns the code left along with whether the line ends inside a /* */ comment.
+func StripComment(line string, inComment bool) (string, bool) {
+	var builder strings.Builder
+	for i := 0; i < len(line); i++ {
+		if inComment {
+			if strings.HasPrefix(line[i:], "*/") {
+				inComment = false
+				i++
+			}
+			continue
+		}
+		if OpenQuote(builder.String()) == 0 {
+			if strings.HasPrefix(line[i:], "//") {
+				break
+			} else if strings.HasPrefix(line[i:], "/*") {
+				inComment = true
+				i++
+				builder.WriteByte(' ')
+				continue
+			}
+		}
+		builder.WriteByte(line[i])
+	}
+	return builder.String(), inComment
+}
+
+// Split a line on whitespace, leaving whitespace inside strings and chars alone
+func SplitFields(line string) []string {
+	var fields []string
+	start := -1
+	for i := 0; i < len(line); i++ {
+		blank := line[i] == ' ' || line[i] == '\t'
+		if start < 0 {
+			if !blank {
+				start = i
+			}
+		} else if blank && OpenQuote(line[start:i]) == 0 {
+			fields = append(fields, line[start:i])
+			start = -1
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, line[start:])
+	}
+	return fields
+}
@@ -0,0 +1,92 @@
+package palexer
+
+import (
+	"fmt"
+	palsm "palsm/palsm_h"
+	"regexp"
+	"sort"
+)
+
+// WithObject assembles a relocatable object file for pallink rather than a program that can be run as is
+func WithObject() Option {
+	return func(lexer *Lexer) {
+		lexer.Object = true
+	}
+}
+
+// Object files
+/*
+	With WithObject (palsm -c) every word holding the address of a label gets a palsm.Relocation, so the linker can
+	move it along with the label. Labels in other objects are declared with .extern before they are used, and labels
+	other objects may use are exported with .global:
+		.extern PRINT_NUM
+		.global MAIN
+		MAIN:
+			CALL PRINT_NUM
+	Only a label on its own, or a label plus or minus a constant (TABLE+4), can be relocated. A wide relocation is
+	the raw word after a palsm.WideImmediate.
+*/
+func (lexer *Lexer) Relocate(section uint32, index int, expression string, wide bool) {
+	if !lexer.Object {
+		return
+	}
+	symbol, err := lexer.RelocationSymbol(expression)
+	if err != nil {
+		lexer.Errorf(lexer.TokenPosition, "%s", err.Error())
+		return
+	}
+	lexer.Relocations = append(lexer.Relocations, palsm.Relocation{Section: section, Index: uint32(index), Symbol: symbol, Wide: wide})
+}
+
+// Find the label an expression is relative to, it has to be a label on its own or plus or minus a constant
+func (lexer *Lexer) RelocationSymbol(expression string) (string, error) {
+	match := regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)([+-].*)?$`).FindStringSubmatch(expression)
+	if match != nil {
+		if _, isConstant := lexer.Constants[match[1]]; !isConstant && (match[2] == "" || !lexer.ExpressionUsesLabel("0"+match[2])) {
+			return match[1], nil
+		}
+	}
+	return "", fmt.Errorf("'%s' cannot be relocated, an object file can only use a label on its own or plus or minus a constant", expression)
+}
+
+// Handle the name given to .global or .extern
+func (lexer *Lexer) DeclareSymbol(name string) {
+	if res, _ := regexp.MatchString("^[A-Za-z_][A-Za-z0-9_]*$", name); !res || IsRegisterName(name) {
+		lexer.Errorf(lexer.TokenPosition, "invalid label name '%s'", name)
+		return
+	}
+	if lexer.Directive == ".global" {
+		if _, ok := lexer.Globals[name]; !ok {
+			lexer.Globals[name] = lexer.TokenPosition
+		}
+		return
+	}
+
+	if !lexer.Object {
+		lexer.Errorf(lexer.TokenPosition, "'.extern' can only be used when assembling an object file with -c")
+	}
+	if _, ok := lexer.LabelToIndex[name]; ok {
+		lexer.Errorf(lexer.TokenPosition, "label '%s' is declared in this file and cannot be '.extern'", name)
+		return
+	}
+	lexer.Externs[name] = true
+	delete(lexer.LabelReferences, name)
+}
+
+// Check every .global names a label declared in this file
+func (lexer *Lexer) VerifyGlobals() {
+	for _, name := range lexer.SortedGlobals() {
+		if _, ok := lexer.LabelToIndex[name]; !ok {
+			lexer.Errorf(lexer.Globals[name], "'.global' label '%s' is not declared in this file", name)
+		}
+	}
+}
+
+func (lexer *Lexer) SortedGlobals() []string {
+	names := make([]string, 0, len(lexer.Globals))
+	for name := range lexer.Globals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
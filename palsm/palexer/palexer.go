@@ -1,10 +1,10 @@
 package palexer
 
 import (
-	"fmt"
-	"os"
+	"math"
+	palsm "palsm/palsm_h"
 	"regexp"
-	"strconv"
+	"sort"
 )
 
 type State int
@@ -24,13 +24,43 @@ type Lexer struct {
 	BuiltString         string
 	Index               int
 	Parameters          []uint32
+	WideParameters      []bool // Set for parameters written as palsm.WideImmediate followed by the raw value
 	ParametersIndex     int
 	CurrentInstruction  uint32
 	LexemesIndex        int
 	NumParams           int8
 	Line                int
-	LabelToIndex        map[string]int   // Map of labels to the index they appear in the data
-	LabelToInstructions map[string][]int // Map of instructions waiting on this label to be recorded into data
+	LineStart           int                   // Index in the data where the current line begins
+	TokenPosition       Position              // Where the string being built started
+	CommentPosition     Position              // Where the /* */ comment being skipped started
+	CommandPosition     Position              // Where the command currently taking parameters started
+	SkipParameters      bool                  // Set after an unrecognized command so its parameters are not reported too
+	File                string                // Name of the file being lexed, used in diagnostics
+	Diagnostics         []Diagnostic          // Every problem found while lexing
+	LabelToIndex        map[string]int        // Map of labels to the index they appear in the data
+	LabelToInstructions map[string][]int      // Map of instructions waiting on this label to be recorded into data
+	LabelReferences     map[string][]Position // Map of where each unresolved label was referenced in the source
+	Fixups              []Fixup               // Values using labels declared after them, patched once lexing is done
+	LabelInData         map[string]bool       // Set for labels declared in the .data section
+	Constants           map[string]int32      // Map of names declared with .equ to their value
+	Data                []int32               // Contents of the .data section
+	InData              bool                  // Set while lexing the .data section
+	Directive           string                // The directive currently taking values
+	DirectivePosition   Position              // Where the directive currently taking values started
+	DirectiveOpen       bool                  // Set while the directive is still expecting a value
+	EquName             string                // Name being declared by the current .equ
+	Macros              map[string]*Macro     // Map of macro names to their definition
+	Expansions          int                   // Number of macro expansions so far, used to make their labels unique
+	Lines               []Origin              // Where each line of the preprocessed source came from, see Preprocess
+	IncludeDirs         []string              // Directories searched by .include, see Include
+	Including           []string              // Files currently being included, to catch include cycles
+	OnceFiles           map[string]bool       // Files with a .once line, which are not included again
+	Object              bool                  // Set when assembling an object file, see Relocate
+	Relocations         []palsm.Relocation    // Words holding the address of a label, for the linker
+	Globals             map[string]Position   // Labels declared with .global, along with where
+	Externs             map[string]bool       // Labels declared with .extern, which are in another object
+	Source              []SourceLine          // The preprocessed source, line by line
+	Spans               []Span                // The words each command and data directive was assembled to
 }
 
 //LabelToIndex := make(map[string]int)
@@ -38,7 +68,7 @@ type Lexer struct {
 /*
 	This function accepts the .palsm file as a long string and lexes through it.
 	The lexer starts in the START state and will stop running once it hits the end of the string.
-	It returns back the lexed array.
+	It returns back the lexed array, problems found along the way are collected into lexer.Diagnostics.
 */
 func (lexer *Lexer) Lex(data string) []uint32 {
 
@@ -48,6 +78,11 @@ func (lexer *Lexer) Lex(data string) []uint32 {
 
 	lexer.LabelToIndex = make(map[string]int)
 	lexer.LabelToInstructions = make(map[string][]int)
+	lexer.LabelReferences = make(map[string][]Position)
+	lexer.LabelInData = make(map[string]bool)
+	lexer.Constants = make(map[string]int32)
+	lexer.Globals = make(map[string]Position)
+	lexer.Externs = make(map[string]bool)
 
 	if len(data) == 0 {
 		return lexemes
@@ -67,16 +102,18 @@ func (lexer *Lexer) Lex(data string) []uint32 {
 			} else if (data[lexer.Index] == '/' && data[lexer.Index+1] == '/') || (data[lexer.Index] == '/' && data[lexer.Index+1] == '*') { // Is it a comment?
 				if data[lexer.Index+1] == '*' {
 					lexer.BeginningChar = '*'
+					lexer.CommentPosition = Position{Line: lexer.Line, Column: lexer.Index - lexer.LineStart + 1}
 				}
 				lexer.Index++
 				lexer.Current_State = COMMENT
 			} else { // It must be a command
+				lexer.TokenPosition = Position{Line: lexer.Line, Column: lexer.Index - lexer.LineStart + 1}
 				lexer.BuiltString += string(data[lexer.Index])
 				lexer.Current_State = BUILDCOMM
 			}
 			break
 		case COMMENT: // You're in a comment line, Consume until you hit end of line
-			if lexer.BeginningChar == '*' && data[lexer.Index:lexer.Index+2] == "*/" {
+			if lexer.BeginningChar == '*' && lexer.Index < len(data)-1 && data[lexer.Index:lexer.Index+2] == "*/" {
 				lexer.Current_State = START
 				lexer.BeginningChar = 0
 				lexer.Index++
@@ -85,7 +122,20 @@ func (lexer *Lexer) Lex(data string) []uint32 {
 			}
 			break
 		case BUILDCOMM: // Build command/Parameter
-			if IsWhitespace(data[lexer.Index]) || data[lexer.Index] == ':' { // You hit end of command or label, stop reading characters
+			if quote := OpenQuote(lexer.BuiltString); quote != 0 { // Inside a string or char, whitespace and ':' are part of it
+				if data[lexer.Index] == '\n' || data[lexer.Index] == '\r' {
+					if quote == '"' {
+						lexer.Errorf(lexer.TokenPosition, "string is missing its closing '\"'")
+					} else {
+						lexer.Errorf(lexer.TokenPosition, "char is missing its closing \"'\"")
+					}
+					lexer.BuiltString += string(quote)
+					lexer.Current_State = DUMP
+					dumping = true
+				} else {
+					lexer.BuiltString += string(data[lexer.Index])
+				}
+			} else if IsWhitespace(data[lexer.Index]) || data[lexer.Index] == ':' { // You hit end of command or label, stop reading characters
 				if data[lexer.Index] == ':' {
 					lexer.BuiltString += ":"
 				}
@@ -104,10 +154,16 @@ func (lexer *Lexer) Lex(data string) []uint32 {
 			lexer.Current_State = START
 			break
 		case END:
+			if lexer.BeginningChar == '*' {
+				lexer.Errorf(lexer.CommentPosition, "comment is missing its closing '*/'")
+			}
 			lexer.DumpCommand(&lexemes)
+			lexer.EndDirective()
+			lexer.ApplyFixups(lexemes)
 			lexer.VerifyLabelResolution()
+			lexer.VerifyGlobals()
 			lexemes[lexer.LexemesIndex] = 0x40000000
-			return lexemes
+			return lexemes[:lexer.LexemesIndex+1]
 		}
 		if dumping {
 			dumping = false
@@ -115,8 +171,10 @@ func (lexer *Lexer) Lex(data string) []uint32 {
 			if lexer.Index < len(data)-1 && data[lexer.Index:lexer.Index+2] == "\r\n" {
 				lexer.Line++
 				lexer.Index++
+				lexer.LineStart = lexer.Index + 1
 			} else if data[lexer.Index] == '\n' {
 				lexer.Line++
+				lexer.LineStart = lexer.Index + 1
 			}
 			lexer.Index++
 		}
@@ -124,26 +182,20 @@ func (lexer *Lexer) Lex(data string) []uint32 {
 }
 
 func (lexer *Lexer) VerifyLabelResolution() {
-	if len(lexer.LabelToInstructions) > 0 {
-		fmt.Println("ERROR: Unresolved labels exist in your code, they go as follows:")
-		for label, _ := range lexer.LabelToInstructions {
-			fmt.Printf("  \"%s\"\n", label)
-		}
-		os.Exit(1)
+	labels := make([]string, 0, len(lexer.LabelReferences))
+	for label := range lexer.LabelReferences {
+		labels = append(labels, label)
 	}
-}
-
-func IsNumeric(num string) bool {
-	for i, char := range num {
-		if i == 0 && char == '-' {
-			continue
-		} else {
-			if char < '0' || char > '9' {
-				return false
+	sort.Strings(labels) // Report in a stable order rather than map order
+	for _, label := range labels {
+		for _, position := range lexer.LabelReferences[label] {
+			if lexer.Object {
+				lexer.Errorf(position, "unresolved label '%s', use '.extern' if it is in another object", label)
+			} else {
+				lexer.Errorf(position, "unresolved label '%s'", label)
 			}
 		}
 	}
-	return true
 }
 
 func ValidateNumParameter(command uint32, paramIndex int) bool {
@@ -156,48 +208,93 @@ func ValidateNumParameter(command uint32, paramIndex int) bool {
 		}
 	case 0x40000011:
 		return false
+	case 0x40000021, 0x40000022: // IN and INC read into a register
+		return false
+	case 0x40000015:
+		if paramIndex == 0 {
+			return false
+		}
 	}
 	return true
 }
 
+// Check if the parameter at paramIndex is a data memory address (LOAD's source and STORE's destination)
+func IsAddressParameter(command uint32, paramIndex int) bool {
+	switch command {
+	case 0x40000015:
+		return paramIndex == 1
+	case 0x40000016:
+		return paramIndex == 0
+	}
+	return false
+}
+
+// Check if the command takes a label as its parameter (JMP, JMPF and CALL)
+func IsLabelCommand(command uint32) bool {
+	switch command {
+	case 0x40000011, 0x40000012, 0x40000013:
+		return true
+	}
+	return false
+}
+
+// Check if the command shifts its first parameter by its second (SHL, SHR and SAR)
+func IsShiftCommand(command uint32) bool {
+	switch command {
+	case 0x4000001C, 0x4000001D, 0x4000001E:
+		return true
+	}
+	return false
+}
+
 func (lexer *Lexer) HandleLabelDecleration(lexemes *[]uint32) {
 	if len(lexer.BuiltString) == 1 {
-		fmt.Printf("ERROR: Label decleration on line %d cannot be empty.\n", lexer.Line)
-		os.Exit(1)
+		lexer.Errorf(lexer.TokenPosition, "label decleration cannot be empty")
+		return
 	}
 
 	lexer.BuiltString = lexer.BuiltString[:len(lexer.BuiltString)-1]
 
+	index := lexer.LexemesIndex
+	if lexer.InData { // Labels in the .data section are addresses in data memory
+		index = len(lexer.Data)
+	}
+
 	if _, ok := lexer.LabelToIndex[lexer.BuiltString]; ok {
-		fmt.Printf("ERROR: Label '%s' is declared more than once.\n", lexer.BuiltString)
-		os.Exit(1)
+		lexer.Errorf(lexer.TokenPosition, "label '%s' is declared more than once", lexer.BuiltString)
+		return
+	} else if lexer.Externs[lexer.BuiltString] {
+		lexer.Errorf(lexer.TokenPosition, "label '%s' is declared '.extern' and cannot be declared in this file", lexer.BuiltString)
+		return
 	} else {
-		lexer.LabelToIndex[lexer.BuiltString] = lexer.LexemesIndex
+		lexer.LabelToIndex[lexer.BuiltString] = index
+		lexer.LabelInData[lexer.BuiltString] = lexer.InData
 	}
 
 	if val, ok := lexer.LabelToInstructions[lexer.BuiltString]; ok {
 		for _, i := range val {
-			(*lexemes)[i] = uint32(lexer.LexemesIndex)
+			(*lexemes)[i] = uint32(index)
 		}
 		delete(lexer.LabelToInstructions, lexer.BuiltString)
 	}
+	delete(lexer.LabelReferences, lexer.BuiltString)
 }
 
 func (lexer *Lexer) HandleLabelParameter(lexemes *[]uint32) {
-	if len(lexer.BuiltString) == 1 {
-		fmt.Printf("ERROR: Label reference on line %d cannot be empty.\n", lexer.Line)
-		os.Exit(1)
-	}
-
+	index := lexer.LexemesIndex + lexer.ParameterWords() // Where the parameter will land once the command is dumped
+	lexer.Relocate(palsm.SECTION_CODE, index, lexer.BuiltString, false)
 	if indexOfLabel, ok := lexer.LabelToIndex[lexer.BuiltString]; ok {
 		lexer.Parameters[lexer.ParametersIndex] = uint32(indexOfLabel)
+	} else if lexer.Externs[lexer.BuiltString] {
+		lexer.Parameters[lexer.ParametersIndex] = 0 // Filled in by the linker
 	} else {
 		lexer.Parameters[lexer.ParametersIndex] = 0
 		if instructions, ok := lexer.LabelToInstructions[lexer.BuiltString]; ok {
-			lexer.LabelToInstructions[lexer.BuiltString] = append(instructions, lexer.LexemesIndex)
+			lexer.LabelToInstructions[lexer.BuiltString] = append(instructions, index)
 		} else {
-			lexer.LabelToInstructions[lexer.BuiltString] = []int{lexer.LexemesIndex}
+			lexer.LabelToInstructions[lexer.BuiltString] = []int{index}
 		}
+		lexer.LabelReferences[lexer.BuiltString] = append(lexer.LabelReferences[lexer.BuiltString], lexer.TokenPosition)
 	}
 	lexer.ParametersIndex++
 	lexer.NumParams++
@@ -205,82 +302,129 @@ func (lexer *Lexer) HandleLabelParameter(lexemes *[]uint32) {
 
 func (lexer *Lexer) DumpCommand(lexemes *[]uint32) {
 	if lexer.Parameters != nil {
+		start := lexer.LexemesIndex
 		if len(lexer.Parameters) != int(lexer.NumParams) {
-			fmt.Printf("ERROR: Command on line %d was expecting %d parameters, received %d.\n", lexer.Line, len(lexer.Parameters), lexer.NumParams)
-			os.Exit(1)
+			lexer.Errorf(lexer.CommandPosition, "command was expecting %d parameters, received %d", len(lexer.Parameters), lexer.NumParams)
 		}
-		for _, param := range lexer.Parameters {
+		for i, param := range lexer.Parameters {
+			if lexer.WideParameters[i] {
+				(*lexemes)[lexer.LexemesIndex] = palsm.WideImmediate
+				lexer.LexemesIndex++
+			}
 			(*lexemes)[lexer.LexemesIndex] = param
 			lexer.LexemesIndex++
 		}
 		(*lexemes)[lexer.LexemesIndex] = lexer.CurrentInstruction
 		lexer.LexemesIndex++
+		lexer.AddSpan(start, lexer.CommandPosition, false)
 	}
 	lexer.ParametersIndex = 0
 	lexer.NumParams = 0
 	lexer.CurrentInstruction = 0
+	lexer.SkipParameters = false
+}
+
+// Count the words taken up by the parameters of the current command so far
+func (lexer *Lexer) ParameterWords() int {
+	words := lexer.ParametersIndex
+	for _, wide := range lexer.WideParameters[:lexer.ParametersIndex] {
+		if wide {
+			words++
+		}
+	}
+	return words
+}
+
+// Check there is room for another parameter on the current command, reporting an error if there isn't
+func (lexer *Lexer) ReserveParameter() bool {
+	if lexer.SkipParameters {
+		return false
+	}
+	if lexer.ParametersIndex == len(lexer.Parameters) {
+		lexer.Errorf(lexer.TokenPosition, "command was expecting %d parameters, received %d", len(lexer.Parameters), lexer.NumParams+1)
+		return false
+	}
+	return true
 }
 
 func (lexer *Lexer) GetCommand(lexemes *[]uint32) {
 
 	// Check if label decleration -- if so, handle it
-	LabelDecleration := false
-	if lexer.BuiltString[len(lexer.BuiltString)-1] == ':' {
+	if lexer.BuiltString[len(lexer.BuiltString)-1] == ':' && lexer.BuiltString[0] != '"' {
 		lexer.DumpCommand(lexemes)
+		lexer.EndDirective()
 		lexer.HandleLabelDecleration(lexemes)
 		lexer.Parameters = nil
-		LabelDecleration = true
 		return
 	}
-	// Check if it's an integer
-	if num, err := strconv.Atoi(lexer.BuiltString); err == nil {
-		if num > 1073741823 || num < -1073741823 {
-			fmt.Printf("ERROR: Max absolute int value is '%d'.", 1073741823)
-			os.Exit(1)
-		}
-		num = num & 0xBFFFFFFF
 
-		if lexer.ParametersIndex == len(lexer.Parameters) {
-			fmt.Printf("ERROR: Command on line %d was expecting %d parameters, received %d.\n", lexer.Line, len(lexer.Parameters), lexer.NumParams+1)
-			os.Exit(1)
+	// Check if it's the value of a directive, if so it goes into the data section
+	if lexer.HandleDirectiveArgument() {
+		return
+	}
+
+	// Check if it's a directive
+	if lexer.BuiltString[0] == '.' {
+		lexer.DumpCommand(lexemes)
+		lexer.Parameters = nil
+		lexer.StartDirective()
+		return
+	}
+
+	// Check if it's an int, a constant declared with .equ or an expression such as 4*8+1 or LABEL+2
+	if lexer.IsExpression(lexer.BuiltString) {
+		lexer.HandleExpressionParameter()
+		return
+	}
+
+	//Check if it's a register
+	if res, _ := regexp.MatchString("^R[0-9]$", lexer.BuiltString); res {
+		if !lexer.ReserveParameter() {
+			return
 		}
 
-		if !ValidateNumParameter(lexer.CurrentInstruction, lexer.ParametersIndex) {
-			// Throw error if it's a register command instruction
-			fmt.Printf("ERROR: Command on line %d was expecting a register as it's parameter.\n", lexer.Line)
-			os.Exit(1)
+		if lexer.BuiltString[1] == '0' {
+			lexer.Errorf(lexer.TokenPosition, "R0 is not a valid register")
+		} else if IsLabelCommand(lexer.CurrentInstruction) {
+			lexer.Errorf(lexer.TokenPosition, "a valid label was expected")
+		} else if IsAddressParameter(lexer.CurrentInstruction, lexer.ParametersIndex) {
+			lexer.Errorf(lexer.TokenPosition, "an address was expected, use [%s] to address through a register", lexer.BuiltString)
 		}
 
-		lexer.Parameters[lexer.ParametersIndex] = uint32(num)
+		reg := uint32((lexer.BuiltString[1] - '1') & 15)
+		lexer.Parameters[lexer.ParametersIndex] = uint32(uint32(0b11<<30) | reg)
 		lexer.ParametersIndex++
 
 		lexer.NumParams++
 
 		return
-	} else if IsNumeric(lexer.BuiltString) {
-		fmt.Printf("ERROR: Max absolute int value is '%d'.", 1073741823)
-		os.Exit(1)
 	}
 
-	//Check if it's a register
-	if res, _ := regexp.MatchString("^R[0-9]$", lexer.BuiltString); res {
-		if lexer.BuiltString[1] == '0' {
-			fmt.Println("ERROR: R0 is not a valid register")
-			os.Exit(1)
+	// Check if it's an indirect address ([R2], [R2+4], [R2-4], [R2+NAME] with a constant from .equ or [R2+SIZE*2])
+	if match := regexp.MustCompile(`^\[R([0-9])(([+-])(.+))?\]$`).FindStringSubmatch(lexer.BuiltString); match != nil {
+		if !lexer.ReserveParameter() {
+			return
 		}
 
-		if lexer.CurrentInstruction == 0x40000011 || lexer.CurrentInstruction == 0x40000012 {
-			fmt.Printf("ERROR: A valid label was expected on line %d.\n", lexer.Line)
-			os.Exit(1)
+		offset := 0
+		if match[2] != "" {
+			if value, err := lexer.ParseValue(match[3] + match[4]); err == nil {
+				offset = int(value)
+			} else {
+				lexer.Errorf(lexer.TokenPosition, "invalid address offset: %s", err.Error())
+			}
 		}
-
-		if lexer.ParametersIndex == len(lexer.Parameters) {
-			fmt.Printf("ERROR: Command on line %d was expecting %d parameters, received %d.\n", lexer.Line, len(lexer.Parameters), lexer.NumParams)
-			os.Exit(1)
+		if match[1] == "0" {
+			lexer.Errorf(lexer.TokenPosition, "R0 is not a valid register")
+		} else if !IsAddressParameter(lexer.CurrentInstruction, lexer.ParametersIndex) {
+			lexer.Errorf(lexer.TokenPosition, "an indirect address can only be used as the address of LOAD or STORE")
+		} else if offset > 0xFFFFFF || offset < -0xFFFFFF {
+			lexer.Errorf(lexer.TokenPosition, "max absolute address offset is '%d'", 0xFFFFFF)
+			offset = 0
 		}
 
-		reg := uint32((lexer.BuiltString[1] - '1') & 15)
-		lexer.Parameters[lexer.ParametersIndex] = uint32(uint32(0b11<<30) | reg)
+		reg := uint32((match[1][0] - '1') & 15)
+		lexer.Parameters[lexer.ParametersIndex] = uint32(0b111<<29) | (uint32(offset)&0x1FFFFFF)<<4 | reg
 		lexer.ParametersIndex++
 
 		lexer.NumParams++
@@ -288,85 +432,118 @@ func (lexer *Lexer) GetCommand(lexemes *[]uint32) {
 		return
 	}
 
-	// Check if it's the parameter trying to be passed in is to a jump-variant command
-	if (lexer.CurrentInstruction == 0x40000011 || lexer.CurrentInstruction == 0x40000012) && lexer.NumParams == 0 {
+	// Check if it's a label being passed in, either to a jump-variant command or as an address to any other command
+	_, _, isCommand := LookupCommand(lexer.BuiltString)
+	if (IsLabelCommand(lexer.CurrentInstruction) && lexer.NumParams == 0) || (!isCommand && !lexer.SkipParameters && lexer.ParametersIndex < len(lexer.Parameters)) {
+		if !IsLabelCommand(lexer.CurrentInstruction) && !ValidateNumParameter(lexer.CurrentInstruction, lexer.ParametersIndex) {
+			lexer.Errorf(lexer.TokenPosition, "command was expecting a register as it's parameter")
+		}
 		lexer.HandleLabelParameter(lexemes)
 		return
 	}
 
 	// Start new command, dump previous command if it exists
 	lexer.DumpCommand(lexemes)
+	lexer.EndDirective()
+	lexer.CommandPosition = lexer.TokenPosition
 
-	var numParams int
-	switch lexer.BuiltString {
-	case "HALT":
-		lexer.CurrentInstruction = 0x40000000
-		numParams = 0
-	case "PEEK":
-		lexer.CurrentInstruction = 0x40000001
-		numParams = 0
-	case "ADD":
-		lexer.CurrentInstruction = 0x40000002
-		numParams = 2
-	case "SUB":
-		lexer.CurrentInstruction = 0x40000003
-		numParams = 2
-	case "MUL":
-		lexer.CurrentInstruction = 0x40000004
-		numParams = 2
-	case "DIV":
-		lexer.CurrentInstruction = 0x40000005
-		numParams = 2
-	case "AND":
-		lexer.CurrentInstruction = 0x40000006
-		numParams = 2
-	case "OR":
-		lexer.CurrentInstruction = 0x40000007
-		numParams = 2
-	case "PUSH":
-		lexer.CurrentInstruction = 0x40000008
-		numParams = 1
-	case "POP":
-		lexer.CurrentInstruction = 0x40000009
-		numParams = 1
-	case "MOV":
-		lexer.CurrentInstruction = 0x4000000A
-		numParams = 2
-	case "EQ":
-		lexer.CurrentInstruction = 0x4000000B
-		numParams = 2
-	case "NEQ":
-		lexer.CurrentInstruction = 0x4000000C
-		numParams = 2
-	case "GT":
-		lexer.CurrentInstruction = 0x4000000D
-		numParams = 2
-	case "LT":
-		lexer.CurrentInstruction = 0x4000000E
-		numParams = 2
-	case "GTE":
-		lexer.CurrentInstruction = 0x4000000F
-		numParams = 2
-	case "LTE":
-		lexer.CurrentInstruction = 0x40000010
-		numParams = 2
-	case "JMP":
-		lexer.CurrentInstruction = 0x40000011
-		numParams = 1
-	case "JMPF":
-		lexer.CurrentInstruction = 0x40000012
-		numParams = 1
-	default:
-		if !LabelDecleration {
-			fmt.Printf("ERROR: Unrecognized command '%s'.", lexer.BuiltString)
-			os.Exit(1)
+	instruction, numParams, ok := LookupCommand(lexer.BuiltString)
+	if !ok {
+		lexer.Errorf(lexer.TokenPosition, "unrecognized command '%s'", lexer.BuiltString)
+		lexer.Parameters = nil
+		lexer.SkipParameters = true
+		return
+	}
+	if lexer.InData {
+		lexer.Errorf(lexer.TokenPosition, "command '%s' cannot be in the .data section, switch back with .text", lexer.BuiltString)
+	}
+	lexer.CurrentInstruction = instruction
+	lexer.Parameters = make([]uint32, numParams) // Max number of parameters a command can have
+	lexer.WideParameters = make([]bool, numParams)
+}
+
+// Add an int, constant or expression parameter to the current command.
+// Expressions using a label declared further down are patched by ApplyFixups once the whole file has been lexed.
+func (lexer *Lexer) HandleExpressionParameter() {
+	text := lexer.BuiltString
+	value, unresolved, err := lexer.Evaluate(text)
+	if err != nil {
+		lexer.Errorf(lexer.TokenPosition, "%s", err.Error())
+		value = 0
+	}
+
+	index := lexer.LexemesIndex + lexer.ParameterWords() // Where the parameter will land once the command is dumped
+	added := lexer.ParametersIndex
+	usesLabel := lexer.ExpressionUsesLabel(text)
+	lexer.HandleIntParameter(int(value), usesLabel)
+	if err != nil || lexer.ParametersIndex == added {
+		return
+	}
+	if usesLabel {
+		if lexer.WideParameters[added] {
+			lexer.Relocate(palsm.SECTION_CODE, index+1, text, true)
+		} else {
+			lexer.Relocate(palsm.SECTION_CODE, index, text, false)
 		}
 	}
-	if LabelDecleration {
-		lexer.Parameters = nil
+	if len(unresolved) == 0 {
+		return
+	}
+	lexer.Fixups = append(lexer.Fixups, Fixup{Expression: text, Index: index, Wide: lexer.WideParameters[added], Position: lexer.TokenPosition})
+	for _, label := range unresolved {
+		lexer.LabelReferences[label] = append(lexer.LabelReferences[label], lexer.TokenPosition)
+	}
+}
+
+// Add an integer parameter to the current command, ints that don't fit in the 30 bits of a tagged word are written
+// as palsm.WideImmediate followed by the raw value. label is set when the value came from a label, which jump
+// commands take where they would not take an int.
+func (lexer *Lexer) HandleIntParameter(num int, label bool) {
+	if num > math.MaxInt32 || num < math.MinInt32 {
+		lexer.Errorf(lexer.TokenPosition, "value of '%s' (%d) does not fit in 32 bits", lexer.BuiltString, num)
+		num = 0
+	}
+
+	if !lexer.ReserveParameter() {
+		return
+	}
+
+	if IsShiftCommand(lexer.CurrentInstruction) && lexer.ParametersIndex == 1 && (num < 0 || num > 31) {
+		lexer.Errorf(lexer.TokenPosition, "shift count must be between 0 and 31")
+	}
+
+	if !(label && IsLabelCommand(lexer.CurrentInstruction)) && !ValidateNumParameter(lexer.CurrentInstruction, lexer.ParametersIndex) {
+		// Throw error if it's a register command instruction
+		lexer.Errorf(lexer.TokenPosition, "command was expecting a register as it's parameter")
+	}
+
+	if num > 1073741823 || num < -1073741823 {
+		lexer.Parameters[lexer.ParametersIndex] = uint32(int32(num))
+		lexer.WideParameters[lexer.ParametersIndex] = true
 	} else {
-		lexer.Parameters = make([]uint32, numParams) // Max number of parameters a command can have
+		lexer.Parameters[lexer.ParametersIndex] = uint32(num & 0xBFFFFFFF)
+	}
+	lexer.ParametersIndex++
+
+	lexer.NumParams++
+}
+
+// Look up the op code and number of parameters of a command
+func LookupCommand(name string) (uint32, int, bool) {
+	for i, command := range palsm.Commands {
+		if command.Name == name {
+			return 0x40000000 | uint32(i), command.NumParams, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Look up the command of an op code
+func LookupOpCode(instruction uint32) (palsm.Command, bool) {
+	if instruction&0xC0000000 != 0x40000000 || int(instruction&0x3FFFFFFF) >= len(palsm.Commands) {
+		return palsm.Command{}, false
 	}
+	return palsm.Commands[instruction&0x3FFFFFFF], true
 }
 
 func IsWhitespace(char byte) bool {
@@ -0,0 +1,93 @@
+package palexer
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnterminatedBlockComment(t *testing.T) {
+	for _, src := range []string{"PUSH 1\n/* x", "PUSH 1\n/*", "PUSH 1 /* x\n y"} {
+		_, diagnostics, err := Assemble(src)
+		if err == nil {
+			t.Errorf("%q: expected an error", src)
+			continue
+		}
+		if len(diagnostics) != 1 || !strings.Contains(diagnostics[0].Message, "comment is missing its closing '*/'") {
+			t.Errorf("%q: unexpected diagnostics %v", src, diagnostics)
+		}
+	}
+
+	if _, diagnostics, err := Assemble("PUSH 1\n/* x */"); err != nil {
+		t.Errorf("closed comment: unexpected diagnostics %v", diagnostics)
+	}
+}
+
+func TestRecursiveMacro(t *testing.T) {
+	for _, src := range []string{
+		".macro A\nA\nA\n.endm\nA",
+		".macro A\nB\n.endm\n.macro B\nA\n.endm\nB",
+	} {
+		done := make(chan []Diagnostic, 1)
+		go func() {
+			_, diagnostics, _ := Assemble(src)
+			done <- diagnostics
+		}()
+		select {
+		case diagnostics := <-done:
+			if len(diagnostics) == 0 || !strings.Contains(diagnostics[0].Message, "invokes itself") {
+				t.Errorf("%q: unexpected diagnostics %v", src, diagnostics)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q: still expanding after 5s", src)
+		}
+	}
+}
+
+func TestMacroExpansionLimit(t *testing.T) {
+	// Every macro invokes the next one twice, 2^20 expansions in all
+	src := ".macro M20\n.endm\n"
+	for i := 19; i >= 0; i-- {
+		src += fmt.Sprintf(".macro M%d\nM%d\nM%d\n.endm\n", i, i+1, i+1)
+	}
+	src += "M0"
+	_, diagnostics, err := Assemble(src)
+	if err == nil || len(diagnostics) != 1 || !strings.Contains(diagnostics[0].Message, "macro expansions") {
+		t.Errorf("unexpected diagnostics %v", diagnostics)
+	}
+}
+
+func TestListingShowsEveryLine(t *testing.T) {
+	src := ".macro INCR reg\n\tADD reg 1\n.endm\nMOV R1 0\nstart: INCR R1\nJMP start"
+	program, diagnostics, err := Assemble(src)
+	if err != nil {
+		t.Fatalf("assembling: %v", diagnostics)
+	}
+	listing := program.Listing()
+	for _, line := range strings.Split(src, "\n") {
+		if !strings.Contains(listing, line) {
+			t.Errorf("listing is missing %q:\n%s", line, listing)
+		}
+	}
+	if !strings.Contains(listing, "<input>:2 (INCR)") {
+		t.Errorf("listing is missing the expanded macro line:\n%s", listing)
+	}
+	if len(program.Code) != 9 || program.Code[6] != 3 { // The label on the invocation is the first word of the macro
+		t.Errorf("unexpected code %08X", program.Code)
+	}
+}
+
+func TestShiftCount(t *testing.T) {
+	for _, src := range []string{"SHL R1 32", "SHR R1 -1", "SAR R1 0x100", ".equ N 40\nSHL R1 N"} {
+		_, diagnostics, err := Assemble(src)
+		if err == nil || len(diagnostics) != 1 || !strings.Contains(diagnostics[0].Message, "shift count must be between 0 and 31") {
+			t.Errorf("%q: unexpected diagnostics %v", src, diagnostics)
+		}
+	}
+	for _, src := range []string{"SHL R1 0", "SAR R1 31", "SHR R1 R2", "BAND R1 0xFFFF"} {
+		if _, diagnostics, err := Assemble(src); err != nil {
+			t.Errorf("%q: unexpected diagnostics %v", src, diagnostics)
+		}
+	}
+}
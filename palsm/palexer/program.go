@@ -0,0 +1,75 @@
+package palexer
+
+import (
+	"fmt"
+	palsm "palsm/palsm_h"
+	"sort"
+)
+
+// Program is the assembled output of a source file
+type Program struct {
+	Code   []uint32        // Words to be written to the .bin file
+	Data   []int32         // Initial contents of data memory, from the .data section
+	Labels map[string]int  // Map of labels to the index they appear in Code, or their address in Data
+	InData map[string]bool // Set for labels that are an address in Data
+
+	Relocations []palsm.Relocation // Only set when assembled as an object, see WithObject
+	Globals     []string
+	Externs     []string
+
+	Source []SourceLine // The preprocessed source, which Spans point into
+	Spans  []Span       // Where the words in Code and Data came from, in the order they were assembled
+}
+
+// Image packs the program into what gets written to a .bin file, along with its debug lines
+func (program Program) Image() palsm.Image {
+	image := palsm.Image{Code: program.Code, Data: program.Data, Debug: program.DebugLines()}
+	for name, index := range program.Labels {
+		section := palsm.SECTION_CODE
+		if program.InData[name] {
+			section = palsm.SECTION_DATA
+		}
+		image.Symbols = append(image.Symbols, palsm.Symbol{Name: name, Section: section, Value: uint32(index)})
+	}
+	sort.Slice(image.Symbols, func(i, j int) bool { return image.Symbols[i].Name < image.Symbols[j].Name })
+	return image
+}
+
+// ObjectImage packs the program into an object file for pallink
+func (program Program) ObjectImage() palsm.Image {
+	image := program.Image()
+	image.Object = true
+	image.Relocations = program.Relocations
+	image.Globals = program.Globals
+	image.Externs = program.Externs
+	return image
+}
+
+// Assemble lexes the given source and returns the resulting program along with every diagnostic found.
+// The returned error is non-nil if any of the diagnostics is an error.
+func Assemble(src string) (Program, []Diagnostic, error) {
+	return AssembleFile("", src)
+}
+
+// AssembleFile behaves like Assemble, using fileName as the file of every diagnostic and to find .include files
+func AssembleFile(fileName string, src string, opts ...Option) (Program, []Diagnostic, error) {
+	lexer := Lexer{Current_State: START, Index: 0, File: fileName}
+	for _, opt := range opts {
+		opt(&lexer)
+	}
+	code := lexer.Lex(lexer.Preprocess(src))
+
+	program := Program{Code: code, Data: lexer.Data, Labels: lexer.LabelToIndex, InData: lexer.LabelInData, Source: lexer.Source, Spans: lexer.Spans}
+	if lexer.Object {
+		program.Relocations = lexer.Relocations
+		program.Globals = lexer.SortedGlobals()
+		for name := range lexer.Externs {
+			program.Externs = append(program.Externs, name)
+		}
+		sort.Strings(program.Externs)
+	}
+	if errors := lexer.ErrorCount(); errors > 0 {
+		return program, lexer.Diagnostics, fmt.Errorf("assembly failed with %d error(s)", errors)
+	}
+	return program, lexer.Diagnostics, nil
+}
@@ -0,0 +1,164 @@
+package pallink
+
+import (
+	"fmt"
+	palsm "palsm/palsm_h"
+	"sort"
+)
+
+// Object is an object file made by palsm -c, along with the name its errors are reported under
+type Object struct {
+	Name  string
+	Image palsm.Image
+}
+
+// Where a global label ended up in the linked image
+type definition struct {
+	object string
+	symbol palsm.Symbol
+}
+
+// Link function
+/*
+	Merge the objects into a single image that can be run. The code and data of each object are placed after the
+	ones before it, the first object's code is where the program starts. Every relocation has the final address of its
+	label added to its word, looked up in the object's own labels first and then in the .global labels of all the
+	objects. Returns every duplicate or undefined label found rather than stopping at the first.
+*/
+func Link(objects []Object) (palsm.Image, []error) {
+	var image palsm.Image
+	var errs []error
+	if len(objects) == 0 {
+		return image, []error{fmt.Errorf("no object files to link")}
+	}
+
+	codeBases := make([]uint32, len(objects))
+	dataBases := make([]uint32, len(objects))
+	globals := make(map[string]definition)
+	for i, object := range objects {
+		if !object.Image.Object {
+			errs = append(errs, fmt.Errorf("%s: not an object file, assemble it with palsm -c", object.Name))
+			continue
+		}
+		codeBases[i] = uint32(len(image.Code))
+		dataBases[i] = uint32(len(image.Data))
+		image.Code = append(image.Code, object.Image.Code...)
+		image.Data = append(image.Data, object.Image.Data...)
+		for _, line := range object.Image.Debug {
+			line.Addr += codeBases[i]
+			image.Debug = append(image.Debug, line)
+		}
+
+		for _, name := range object.Image.Globals {
+			symbol, ok := findSymbol(object.Image, name)
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: global '%s' is not declared", object.Name, name))
+				continue
+			}
+			symbol.Value += base(symbol.Section, codeBases[i], dataBases[i])
+			if previous, ok := globals[name]; ok {
+				errs = append(errs, fmt.Errorf("%s: duplicate symbol '%s', already defined in %s", object.Name, name, previous.object))
+				continue
+			}
+			globals[name] = definition{object: object.Name, symbol: symbol}
+		}
+	}
+	image.Entry = objects[0].Image.Entry
+
+	// Carry on after duplicates so undefined labels are reported too, the first definition of a duplicate is used
+	seen := make(map[string]bool)
+	for i, object := range objects {
+		if !object.Image.Object {
+			continue
+		}
+		undefined := make(map[string]bool)
+		for _, relocation := range object.Image.Relocations {
+			var delta int64
+			if symbol, ok := findSymbol(object.Image, relocation.Symbol); ok {
+				delta = int64(base(symbol.Section, codeBases[i], dataBases[i]))
+			} else if global, ok := globals[relocation.Symbol]; ok {
+				delta = int64(global.symbol.Value)
+			} else {
+				if !undefined[relocation.Symbol] {
+					errs = append(errs, fmt.Errorf("%s: undefined symbol '%s'", object.Name, relocation.Symbol))
+					undefined[relocation.Symbol] = true
+				}
+				continue
+			}
+			if err := relocate(&image, relocation, codeBases[i], dataBases[i], delta); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s", object.Name, err.Error()))
+			}
+		}
+
+		// Keep every label for the debugger, a local label only if no other object already has one by that name
+		for _, symbol := range object.Image.Symbols {
+			if global, ok := globals[symbol.Name]; ok {
+				if !seen[symbol.Name] {
+					image.Symbols = append(image.Symbols, global.symbol)
+					seen[symbol.Name] = true
+				}
+			} else if !seen[symbol.Name] {
+				symbol.Value += base(symbol.Section, codeBases[i], dataBases[i])
+				image.Symbols = append(image.Symbols, symbol)
+				seen[symbol.Name] = true
+			}
+		}
+	}
+	sort.Slice(image.Symbols, func(i, j int) bool { return image.Symbols[i].Name < image.Symbols[j].Name })
+	return image, errs
+}
+
+func findSymbol(image palsm.Image, name string) (palsm.Symbol, bool) {
+	for _, symbol := range image.Symbols {
+		if symbol.Name == name {
+			return symbol, true
+		}
+	}
+	return palsm.Symbol{}, false
+}
+
+// Where an object's section starts in the linked image
+func base(section uint32, codeBase uint32, dataBase uint32) uint32 {
+	if section == palsm.SECTION_DATA {
+		return dataBase
+	}
+	return codeBase
+}
+
+// Add delta to the word a relocation points at. A word in the code is either the raw value after a
+// palsm.WideImmediate, for a wide relocation, or an int tagged in its top 2 bits, which has to stay within 30 bits.
+func relocate(image *palsm.Image, relocation palsm.Relocation, codeBase uint32, dataBase uint32, delta int64) error {
+	if relocation.Section == palsm.SECTION_DATA {
+		index := int(dataBase + relocation.Index)
+		if index >= len(image.Data) {
+			return fmt.Errorf("relocation of '%s' lies outside the data", relocation.Symbol)
+		}
+		image.Data[index] = int32(int64(image.Data[index]) + delta)
+		return nil
+	}
+
+	index := int(codeBase + relocation.Index)
+	if relocation.Section != palsm.SECTION_CODE || index >= len(image.Code) {
+		return fmt.Errorf("relocation of '%s' lies outside the code", relocation.Symbol)
+	}
+	word := image.Code[index]
+	if relocation.Wide {
+		image.Code[index] = uint32(int32(int64(int32(word)) + delta))
+		return nil
+	}
+	var value int64
+	switch word >> 30 {
+	case 0:
+		value = int64(word)
+	case 2:
+		value = int64(int32(word | 0x40000000))
+	default:
+		return fmt.Errorf("relocation of '%s' at 0x%X is not an int", relocation.Symbol, index)
+	}
+	value += delta
+	if value > 1073741823 || value < -1073741823 {
+		return fmt.Errorf("address of '%s' at 0x%X (%d) does not fit in 30 bits", relocation.Symbol, index, value)
+	}
+	image.Code[index] = uint32(value & 0xBFFFFFFF)
+	return nil
+}
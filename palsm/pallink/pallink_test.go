@@ -0,0 +1,58 @@
+package pallink
+
+import (
+	"palsm/palexer"
+	palsm "palsm/palsm_h"
+	"strings"
+	"testing"
+)
+
+// Assemble src with palsm -c and read it back the way pallink does
+func object(t *testing.T, name string, src string) Object {
+	t.Helper()
+	program, diagnostics, err := palexer.AssembleFile(name, src, palexer.WithObject())
+	if err != nil {
+		t.Fatalf("assembling %s: %v", name, diagnostics)
+	}
+	image, err := palsm.DecodeImage(palsm.EncodeImage(program.ObjectImage()))
+	if err != nil {
+		t.Fatalf("decoding %s: %v", name, err)
+	}
+	return Object{Name: name, Image: image}
+}
+
+func TestWideRelocation(t *testing.T) {
+	a := object(t, "a.palsm", ".extern F\nMOV R1 F+1073741824\nCALL F")
+	b := object(t, "b.palsm", ".global F\nPUSH 1\nF:\nRET")
+	if len(a.Image.Relocations) != 2 || !a.Image.Relocations[0].Wide || a.Image.Relocations[1].Wide {
+		t.Fatalf("unexpected relocations %+v", a.Image.Relocations)
+	}
+
+	image, errs := Link([]Object{a, b})
+	if len(errs) > 0 {
+		t.Fatalf("link: %v", errs)
+	}
+	f := uint32(len(a.Image.Code) + 2) // After the PUSH 1 of b
+	wide := a.Image.Relocations[0].Index
+	if image.Code[wide-1] != palsm.WideImmediate || image.Code[wide] != 1073741824+f {
+		t.Errorf("MOV R1 F+1073741824 linked to %08X %08X", image.Code[wide-1], image.Code[wide])
+	}
+	if call := a.Image.Relocations[1].Index; image.Code[call] != f {
+		t.Errorf("CALL F linked to %08X, expected %08X", image.Code[call], f)
+	}
+}
+
+func TestDuplicateAndUndefinedSymbols(t *testing.T) {
+	a := object(t, "a.palsm", ".global F\n.extern G\nF:\nCALL G")
+	b := object(t, "b.palsm", ".global F\nF:\nRET")
+	_, errs := Link([]Object{a, b})
+
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	all := strings.Join(messages, "\n")
+	if len(errs) != 2 || !strings.Contains(all, "duplicate symbol 'F'") || !strings.Contains(all, "undefined symbol 'G'") {
+		t.Errorf("unexpected errors:\n%s", all)
+	}
+}
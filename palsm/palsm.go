@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"palsm/palexer"
@@ -8,19 +9,66 @@ import (
 )
 
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Println("Usage: ./palsm <file.palsm>")
+	var includeDirs palsm.StringList
+	flag.Var(&includeDirs, "I", "also look for .include files in this directory, may be given more than once")
+	object := flag.Bool("c", false, "write a relocatable object file (.o) for pallink instead of a .bin file")
+	listing := flag.String("listing", "", "write a listing of every source line with the address and words it assembled to into this file")
+	symbolMap := flag.String("map", "", "write every label and its address, sorted by name and by address, into this file")
+	strip := flag.Bool("strip", false, "leave out the debug section that maps instructions back to their source lines")
+	flag.Usage = func() {
+		fmt.Println("Usage: ./palsm [-c] [--strip] [-I <dir>]... [--listing <file.lst>] [--map <file.map>] <file.palsm>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
 		os.Exit(1)
 	}
+	fileName := flag.Arg(0)
 
-	data := palsm.ReadFile(os.Args[1])
+	data := palsm.ReadFile(fileName)
 
-	lexer := palexer.Lexer{Current_State: palexer.START, Index: 0}
-	instructions := lexer.Lex(data)
+	opts := []palexer.Option{palexer.WithIncludeDirs(includeDirs...)}
+	if *object {
+		opts = append(opts, palexer.WithObject())
+	}
+	program, diagnostics, err := palexer.AssembleFile(fileName, data, opts...)
+	for _, diagnostic := range diagnostics {
+		fmt.Fprintln(os.Stderr, diagnostic)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
 
-	if len(instructions) == 0 {
+	if len(program.Code) == 0 {
 		os.Exit(0)
 	}
 
-	palsm.WriteBinaryFile(os.Args[1], instructions)
+	if *listing != "" {
+		if err := os.WriteFile(*listing, []byte(program.Listing()), 0644); err != nil {
+			fmt.Printf("ERROR: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	if *symbolMap != "" {
+		if err := os.WriteFile(*symbolMap, []byte(program.SymbolMap()), 0644); err != nil {
+			fmt.Printf("ERROR: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	write := palsm.WriteImageFile
+	image := program.Image()
+	if *object {
+		write = palsm.WriteObjectFile
+		image = program.ObjectImage()
+	}
+	if *strip {
+		image.Debug = nil
+	}
+	if err := write(fileName, image); err != nil {
+		fmt.Printf("ERROR: %s\n", err.Error())
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,75 @@
+package palsm_h
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// DebugLine is where the instruction starting at Addr was assembled from, kept in the debug section of an image
+type DebugLine struct {
+	Addr   uint32
+	File   string
+	Line   uint32
+	Column uint32
+	Func   string // Label of the function the instruction is in, empty if there isn't one before it
+}
+
+// String gives the line as "loop.palsm:14 (in func)"
+func (line DebugLine) String() string {
+	text := fmt.Sprintf("%s:%d", line.File, line.Line)
+	if line.Func != "" {
+		text += fmt.Sprintf(" (in %s)", line.Func)
+	}
+	return text
+}
+
+// FindDebugLine returns the line of the instruction at addr, lines has to be sorted by address
+func FindDebugLine(lines []DebugLine, addr int) (DebugLine, bool) {
+	i := sort.Search(len(lines), func(i int) bool { return int(lines[i].Addr) > addr }) - 1
+	if i < 0 {
+		return DebugLine{}, false
+	}
+	return lines[i], true
+}
+
+func encodeDebugLines(lines []DebugLine) []byte {
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(lines)))
+	for _, line := range lines {
+		out = binary.BigEndian.AppendUint32(out, line.Addr)
+		out = appendName(out, line.File)
+		out = binary.BigEndian.AppendUint32(out, line.Line)
+		out = binary.BigEndian.AppendUint32(out, line.Column)
+		out = appendName(out, line.Func)
+	}
+	return out
+}
+
+func decodeDebugLines(section []byte) ([]DebugLine, error) {
+	truncated := fmt.Errorf("%w: debug section is truncated", ErrCorruptImage)
+	if len(section) < 4 {
+		return nil, truncated
+	}
+	count := int(binary.BigEndian.Uint32(section[0:4]))
+	section = section[4:]
+	var lines []DebugLine
+	for i := 0; i < count; i++ {
+		if len(section) < 4 {
+			return nil, truncated
+		}
+		line := DebugLine{Addr: binary.BigEndian.Uint32(section[0:4])}
+		file, rest, ok := readName(section[4:])
+		if !ok || len(rest) < 8 {
+			return nil, truncated
+		}
+		line.File = file
+		line.Line = binary.BigEndian.Uint32(rest[0:4])
+		line.Column = binary.BigEndian.Uint32(rest[4:8])
+		if line.Func, section, ok = readName(rest[8:]); !ok {
+			return nil, truncated
+		}
+		lines = append(lines, line)
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].Addr < lines[j].Addr })
+	return lines, nil
+}
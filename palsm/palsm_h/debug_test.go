@@ -0,0 +1,64 @@
+package palsm_h
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestFindDebugLine(t *testing.T) {
+	lines := []DebugLine{
+		{Addr: 0, File: "main.palsm", Line: 2, Func: "MAIN"},
+		{Addr: 3, File: "main.palsm", Line: 3, Func: "MAIN"},
+		{Addr: 7, File: "lib.palsm", Line: 10, Func: "PRINT"},
+	}
+	cases := []struct {
+		addr     int
+		expected string
+		ok       bool
+	}{
+		{-1, "", false},
+		{0, "main.palsm:2 (in MAIN)", true},
+		{2, "main.palsm:2 (in MAIN)", true}, // The middle of an instruction is the instruction it is in
+		{3, "main.palsm:3 (in MAIN)", true},
+		{7, "lib.palsm:10 (in PRINT)", true},
+		{100, "lib.palsm:10 (in PRINT)", true},
+	}
+	for _, c := range cases {
+		line, ok := FindDebugLine(lines, c.addr)
+		if ok != c.ok || (ok && line.String() != c.expected) {
+			t.Errorf("FindDebugLine(%d) = %q, %t, expected %q, %t", c.addr, line.String(), ok, c.expected, c.ok)
+		}
+	}
+	if _, ok := FindDebugLine(nil, 0); ok {
+		t.Errorf("found a line with no debug lines")
+	}
+	if text := (DebugLine{File: "x.palsm", Line: 4}).String(); text != "x.palsm:4" {
+		t.Errorf("got %q, expected x.palsm:4 with no function", text)
+	}
+}
+
+// The section types in the section table of an encoded image
+func sectionKinds(bytes []byte) map[uint32]bool {
+	kinds := make(map[uint32]bool)
+	count := int(binary.BigEndian.Uint32(bytes[12:16]))
+	for i := 0; i < count; i++ {
+		kinds[binary.BigEndian.Uint32(bytes[imageHeaderSize+i*sectionEntrySize:])] = true
+	}
+	return kinds
+}
+
+func TestStrippedImageHasNoDebugSection(t *testing.T) {
+	image := Image{Code: []uint32{0x40000000}, Debug: []DebugLine{{Addr: 0, File: "main.palsm", Line: 1}}}
+	if !sectionKinds(EncodeImage(image))[SECTION_DEBUG] {
+		t.Errorf("image with debug lines has no debug section")
+	}
+
+	image.Debug = nil // What --strip does
+	bytes := EncodeImage(image)
+	if sectionKinds(bytes)[SECTION_DEBUG] {
+		t.Errorf("stripped image still has a debug section")
+	}
+	if decoded, err := DecodeImage(bytes); err != nil || decoded.Debug != nil {
+		t.Errorf("decoded stripped image with debug lines %v, %v", decoded.Debug, err)
+	}
+}
@@ -0,0 +1,366 @@
+package palsm_h
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+/*
+	Layout of a .bin file, every field is big-endian:
+		magic          4 bytes  "PALB"
+		version        uint16   ImageVersion
+		flags          uint16   FLAG_OBJECT for object files made by palsm -c, otherwise 0
+		entry          uint32   index of the first word to execute
+		section count  uint32
+		section table  section count * {type uint32, offset uint32, size uint32}, offset and size in bytes
+		sections       the bytes each entry in the section table points at
+		checksum       uint32   CRC32 (IEEE) of every byte before it
+	Object files have the relocations, globals and externs sections as well, pallink turns them into a .bin file.
+	The debug section is left out when there are no debug lines, such as after palsm --strip.
+*/
+const ImageMagic = "PALB"
+const ImageVersion uint16 = 1
+
+// Section types
+const (
+	SECTION_CODE    uint32 = 1
+	SECTION_DATA    uint32 = 2
+	SECTION_SYMBOLS uint32 = 3
+
+	SECTION_RELOCATIONS uint32 = 4 // Object files only
+	SECTION_GLOBALS     uint32 = 5 // Object files only
+	SECTION_EXTERNS     uint32 = 6 // Object files only
+	SECTION_DEBUG       uint32 = 7
+)
+
+// Header flags
+const FLAG_OBJECT uint16 = 1
+
+const imageHeaderSize = 16
+const sectionEntrySize = 12
+
+var (
+	ErrNotImage           = errors.New("not a PAL image")
+	ErrUnsupportedVersion = errors.New("unsupported image version")
+	ErrCorruptImage       = errors.New("corrupt image")
+)
+
+// Symbol is a label and the section its value is an index into
+type Symbol struct {
+	Name    string
+	Section uint32 // SECTION_CODE or SECTION_DATA
+	Value   uint32
+}
+
+// Relocation is a word that holds the address of a label, which moves once objects are linked together.
+// The linker adds the final address of Symbol to the word, less the address it had in the object.
+type Relocation struct {
+	Section uint32 // SECTION_CODE or SECTION_DATA, the section the word is in
+	Index   uint32 // Index of the word in its section
+	Symbol  string // A label of the object or one of its externs
+	Wide    bool   // The word is the raw int32 after a WideImmediate rather than an int tagged in its top 2 bits
+}
+
+// Relocation flags, stored after the index of each relocation
+const RELOCATION_WIDE uint32 = 1
+
+// Image is everything stored in a .bin file, or in an object file when Object is set
+type Image struct {
+	Entry   uint32
+	Code    []uint32
+	Data    []int32
+	Symbols []Symbol
+	Debug   []DebugLine // Sorted by address
+
+	Object      bool
+	Relocations []Relocation
+	Globals     []string // Labels other objects may use
+	Externs     []string // Labels this object uses from other objects
+}
+
+// A section about to be written, along with its type
+type imageSection struct {
+	kind  uint32
+	bytes []byte
+}
+
+// Turn the image into the bytes of a .bin file
+func EncodeImage(image Image) []byte {
+	code := make([]byte, 0, len(image.Code)*4)
+	for _, word := range image.Code {
+		code = binary.BigEndian.AppendUint32(code, word)
+	}
+	data := make([]byte, 0, len(image.Data)*4)
+	for _, word := range image.Data {
+		data = binary.BigEndian.AppendUint32(data, uint32(word))
+	}
+	symbols := binary.BigEndian.AppendUint32(nil, uint32(len(image.Symbols)))
+	for _, symbol := range image.Symbols {
+		symbols = appendName(symbols, symbol.Name)
+		symbols = binary.BigEndian.AppendUint32(symbols, symbol.Section)
+		symbols = binary.BigEndian.AppendUint32(symbols, symbol.Value)
+	}
+
+	sections := []imageSection{{SECTION_CODE, code}, {SECTION_DATA, data}, {SECTION_SYMBOLS, symbols}}
+
+	if len(image.Debug) > 0 {
+		sections = append(sections, imageSection{SECTION_DEBUG, encodeDebugLines(image.Debug)})
+	}
+
+	flags := uint16(0)
+	if image.Object {
+		flags |= FLAG_OBJECT
+		relocations := binary.BigEndian.AppendUint32(nil, uint32(len(image.Relocations)))
+		for _, relocation := range image.Relocations {
+			relocations = binary.BigEndian.AppendUint32(relocations, relocation.Section)
+			relocations = binary.BigEndian.AppendUint32(relocations, relocation.Index)
+			relocationFlags := uint32(0)
+			if relocation.Wide {
+				relocationFlags |= RELOCATION_WIDE
+			}
+			relocations = binary.BigEndian.AppendUint32(relocations, relocationFlags)
+			relocations = appendName(relocations, relocation.Symbol)
+		}
+		sections = append(sections, imageSection{SECTION_RELOCATIONS, relocations},
+			imageSection{SECTION_GLOBALS, encodeNames(image.Globals)}, imageSection{SECTION_EXTERNS, encodeNames(image.Externs)})
+	}
+
+	out := append([]byte{}, ImageMagic...)
+	out = binary.BigEndian.AppendUint16(out, ImageVersion)
+	out = binary.BigEndian.AppendUint16(out, flags)
+	out = binary.BigEndian.AppendUint32(out, image.Entry)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(sections)))
+	offset := imageHeaderSize + sectionEntrySize*len(sections)
+	for _, section := range sections {
+		out = binary.BigEndian.AppendUint32(out, section.kind)
+		out = binary.BigEndian.AppendUint32(out, uint32(offset))
+		out = binary.BigEndian.AppendUint32(out, uint32(len(section.bytes)))
+		offset += len(section.bytes)
+	}
+	for _, section := range sections {
+		out = append(out, section.bytes...)
+	}
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out))
+}
+
+// Read the bytes of a .bin file back into an image, checking it is whole and was made for this version
+func DecodeImage(bytes []byte) (Image, error) {
+	var image Image
+	if len(bytes) < 4 || string(bytes[:4]) != ImageMagic {
+		return image, ErrNotImage
+	}
+	if len(bytes) < imageHeaderSize+4 {
+		return image, fmt.Errorf("%w: file is truncated", ErrCorruptImage)
+	}
+	if version := binary.BigEndian.Uint16(bytes[4:6]); version != ImageVersion {
+		return image, fmt.Errorf("%w: version %d, expected %d", ErrUnsupportedVersion, version, ImageVersion)
+	}
+	body := bytes[:len(bytes)-4]
+	if binary.BigEndian.Uint32(bytes[len(bytes)-4:]) != crc32.ChecksumIEEE(body) {
+		return image, fmt.Errorf("%w: checksum mismatch", ErrCorruptImage)
+	}
+
+	image.Object = binary.BigEndian.Uint16(body[6:8])&FLAG_OBJECT != 0
+	image.Entry = binary.BigEndian.Uint32(body[8:12])
+	count := int(binary.BigEndian.Uint32(body[12:16]))
+	if count > (len(body)-imageHeaderSize)/sectionEntrySize {
+		return image, fmt.Errorf("%w: section table is truncated", ErrCorruptImage)
+	}
+	for i := 0; i < count; i++ {
+		entry := body[imageHeaderSize+i*sectionEntrySize:]
+		kind := binary.BigEndian.Uint32(entry[0:4])
+		offset := uint64(binary.BigEndian.Uint32(entry[4:8]))
+		size := uint64(binary.BigEndian.Uint32(entry[8:12]))
+		if offset+size > uint64(len(body)) {
+			return image, fmt.Errorf("%w: section %d lies outside the file", ErrCorruptImage, kind)
+		}
+		section := body[offset : offset+size]
+
+		switch kind {
+		case SECTION_CODE, SECTION_DATA:
+			if size%4 != 0 {
+				return image, fmt.Errorf("%w: section %d is not a whole number of words", ErrCorruptImage, kind)
+			}
+			for j := 0; j < len(section); j += 4 {
+				word := binary.BigEndian.Uint32(section[j : j+4])
+				if kind == SECTION_CODE {
+					image.Code = append(image.Code, word)
+				} else {
+					image.Data = append(image.Data, int32(word))
+				}
+			}
+		case SECTION_SYMBOLS:
+			symbols, err := decodeSymbols(section)
+			if err != nil {
+				return image, err
+			}
+			image.Symbols = symbols
+		case SECTION_RELOCATIONS:
+			relocations, err := decodeRelocations(section)
+			if err != nil {
+				return image, err
+			}
+			image.Relocations = relocations
+		case SECTION_DEBUG:
+			lines, err := decodeDebugLines(section)
+			if err != nil {
+				return image, err
+			}
+			image.Debug = lines
+		case SECTION_GLOBALS, SECTION_EXTERNS:
+			names, err := decodeNames(section)
+			if err != nil {
+				return image, err
+			}
+			if kind == SECTION_GLOBALS {
+				image.Globals = names
+			} else {
+				image.Externs = names
+			}
+		}
+		// Unknown sections are skipped so newer tools can add their own
+	}
+
+	if len(image.Code) > 0 && int(image.Entry) >= len(image.Code) {
+		return image, fmt.Errorf("%w: entry point 0x%X lies outside the code", ErrCorruptImage, image.Entry)
+	}
+	return image, nil
+}
+
+// Names are written as a uint16 length followed by the bytes of the name
+func appendName(out []byte, name string) []byte {
+	out = binary.BigEndian.AppendUint16(out, uint16(len(name)))
+	return append(out, name...)
+}
+
+func encodeNames(names []string) []byte {
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(names)))
+	for _, name := range names {
+		out = appendName(out, name)
+	}
+	return out
+}
+
+// Read a name off the front of section, returning what is left after it
+func readName(section []byte) (string, []byte, bool) {
+	if len(section) < 2 {
+		return "", nil, false
+	}
+	length := int(binary.BigEndian.Uint16(section[0:2]))
+	if len(section) < 2+length {
+		return "", nil, false
+	}
+	return string(section[2 : 2+length]), section[2+length:], true
+}
+
+func decodeNames(section []byte) ([]string, error) {
+	truncated := fmt.Errorf("%w: name section is truncated", ErrCorruptImage)
+	if len(section) < 4 {
+		return nil, truncated
+	}
+	count := int(binary.BigEndian.Uint32(section[0:4]))
+	section = section[4:]
+	var names []string
+	for i := 0; i < count; i++ {
+		name, rest, ok := readName(section)
+		if !ok {
+			return nil, truncated
+		}
+		names = append(names, name)
+		section = rest
+	}
+	return names, nil
+}
+
+func decodeRelocations(section []byte) ([]Relocation, error) {
+	truncated := fmt.Errorf("%w: relocation section is truncated", ErrCorruptImage)
+	if len(section) < 4 {
+		return nil, truncated
+	}
+	count := int(binary.BigEndian.Uint32(section[0:4]))
+	section = section[4:]
+	var relocations []Relocation
+	for i := 0; i < count; i++ {
+		if len(section) < 12 {
+			return nil, truncated
+		}
+		relocation := Relocation{Section: binary.BigEndian.Uint32(section[0:4]), Index: binary.BigEndian.Uint32(section[4:8])}
+		relocation.Wide = binary.BigEndian.Uint32(section[8:12])&RELOCATION_WIDE != 0
+		name, rest, ok := readName(section[12:])
+		if !ok {
+			return nil, truncated
+		}
+		relocation.Symbol = name
+		relocations = append(relocations, relocation)
+		section = rest
+	}
+	return relocations, nil
+}
+
+func decodeSymbols(section []byte) ([]Symbol, error) {
+	truncated := fmt.Errorf("%w: symbol section is truncated", ErrCorruptImage)
+	if len(section) < 4 {
+		return nil, truncated
+	}
+	count := int(binary.BigEndian.Uint32(section[0:4]))
+	section = section[4:]
+	var symbols []Symbol
+	for i := 0; i < count; i++ {
+		if len(section) < 2 {
+			return nil, truncated
+		}
+		nameLength := int(binary.BigEndian.Uint16(section[0:2]))
+		if len(section) < 2+nameLength+8 {
+			return nil, truncated
+		}
+		symbols = append(symbols, Symbol{
+			Name:    string(section[2 : 2+nameLength]),
+			Section: binary.BigEndian.Uint32(section[2+nameLength:]),
+			Value:   binary.BigEndian.Uint32(section[6+nameLength:]),
+		})
+		section = section[10+nameLength:]
+	}
+	return symbols, nil
+}
+
+// Read a legacy raw .bin file, a stream of big-endian words with no header: the code, then if there is any data,
+// DataMarker followed by the data. Files from before .data was added are just the code, which reads the same way.
+func DecodeRawImage(bytes []byte) (Image, error) {
+	if len(bytes)%4 != 0 {
+		return Image{}, fmt.Errorf("%w: raw image is not a whole number of words", ErrCorruptImage)
+	}
+	words := make([]uint32, len(bytes)/4)
+	for i := range words {
+		words[i] = binary.BigEndian.Uint32(bytes[i*4 : i*4+4])
+	}
+	code, data := SplitImage(words)
+	return Image{Code: code, Data: data}, nil
+}
+
+// Write the image to a .bin file next to filePath
+func WriteImageFile(filePath string, image Image) error {
+	fileName := filePath[0:len(filePath)-len(filepath.Ext(filePath))] + ".bin"
+	return os.WriteFile(fileName, EncodeImage(image), 0644)
+}
+
+// Write the object image to a .o file next to filePath
+func WriteObjectFile(filePath string, image Image) error {
+	fileName := filePath[0:len(filePath)-len(filepath.Ext(filePath))] + ".o"
+	return os.WriteFile(fileName, EncodeImage(image), 0644)
+}
+
+// Read an image from a .bin file, legacy raw files are only accepted when allowRaw is set
+func ReadImageFile(fileName string, allowRaw bool) (Image, error) {
+	bytes, err := os.ReadFile(fileName)
+	if err != nil {
+		return Image{}, err
+	}
+	if allowRaw && (len(bytes) < 4 || string(bytes[:4]) != ImageMagic) {
+		return DecodeRawImage(bytes)
+	}
+	return DecodeImage(bytes)
+}
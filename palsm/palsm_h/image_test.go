@@ -0,0 +1,107 @@
+package palsm_h
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"reflect"
+	"testing"
+)
+
+func TestImageRoundTrip(t *testing.T) {
+	images := []Image{
+		{Code: []uint32{0x40000000}},
+		{
+			Entry:   2,
+			Code:    []uint32{0xC0000000, 0x00000005, 0x4000000A, WideImmediate, 0x80000000, 0x4000001F, 0x40000000},
+			Data:    []int32{1, -1, 0x7FFFFFFF, -0x80000000},
+			Symbols: []Symbol{{Name: "MAIN", Section: SECTION_CODE, Value: 2}, {Name: "TABLE", Section: SECTION_DATA, Value: 1}},
+			Debug:   []DebugLine{{Addr: 0, File: "main.palsm", Line: 3, Column: 1, Func: "MAIN"}, {Addr: 3, File: "main.palsm", Line: 4, Column: 2}},
+		},
+		{
+			Code:   []uint32{WideImmediate, 0, 0x40000013, 0, 0x40000013, 0x40000000},
+			Data:   []int32{0},
+			Object: true,
+			Relocations: []Relocation{
+				{Section: SECTION_CODE, Index: 1, Symbol: "FAR", Wide: true},
+				{Section: SECTION_CODE, Index: 3, Symbol: "NEAR"},
+				{Section: SECTION_DATA, Index: 0, Symbol: "NEAR"},
+			},
+			Globals: []string{"NEAR"},
+			Externs: []string{"FAR", "ÜBER"},
+		},
+	}
+	for i, image := range images {
+		decoded, err := DecodeImage(EncodeImage(image))
+		if err != nil {
+			t.Errorf("image %d: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, image) {
+			t.Errorf("image %d: decoded\n%+v\nexpected\n%+v", i, decoded, image)
+		}
+	}
+}
+
+// Recompute the checksum after changing the bytes of an image
+func reseal(bytes []byte) []byte {
+	body := bytes[:len(bytes)-4]
+	return binary.BigEndian.AppendUint32(body, crc32.ChecksumIEEE(body))
+}
+
+func TestDecodeBadImages(t *testing.T) {
+	image := Image{Code: []uint32{0xC0000000, 0x00000005, 0x4000000A, 0x40000000}, Data: []int32{7}}
+	cases := []struct {
+		name   string
+		change func([]byte) []byte
+		err    error
+	}{
+		{"foreign magic", func(b []byte) []byte { return append([]byte("\x7fELF"), b[4:]...) }, ErrNotImage},
+		{"empty", func(b []byte) []byte { return nil }, ErrNotImage},
+		{"truncated header", func(b []byte) []byte { return b[:10] }, ErrCorruptImage},
+		{"truncated file", func(b []byte) []byte { return b[:len(b)-6] }, ErrCorruptImage},
+		{"checksum mismatch", func(b []byte) []byte { b[len(b)-10] ^= 1; return b }, ErrCorruptImage},
+		{"version mismatch", func(b []byte) []byte { binary.BigEndian.PutUint16(b[4:6], ImageVersion+1); return reseal(b) }, ErrUnsupportedVersion},
+		{"truncated section table", func(b []byte) []byte { binary.BigEndian.PutUint32(b[12:16], 1000); return reseal(b) }, ErrCorruptImage},
+		{"section outside the file", func(b []byte) []byte { binary.BigEndian.PutUint32(b[20:24], 0xFFFFFFF0); return reseal(b) }, ErrCorruptImage},
+		{"section size past the end", func(b []byte) []byte { binary.BigEndian.PutUint32(b[24:28], 1<<20); return reseal(b) }, ErrCorruptImage},
+		{"code size not a multiple of 4", func(b []byte) []byte { binary.BigEndian.PutUint32(b[24:28], 15); return reseal(b) }, ErrCorruptImage},
+		{"entry outside the code", func(b []byte) []byte { binary.BigEndian.PutUint32(b[8:12], 4); return reseal(b) }, ErrCorruptImage},
+	}
+	for _, c := range cases {
+		_, err := DecodeImage(c.change(EncodeImage(image)))
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: got %v, expected %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestDecodeRawImage(t *testing.T) {
+	words := func(words ...uint32) []byte {
+		var bytes []byte
+		for _, word := range words {
+			bytes = binary.BigEndian.AppendUint32(bytes, word)
+		}
+		return bytes
+	}
+	cases := []struct {
+		name  string
+		bytes []byte
+		code  []uint32
+		data  []int32
+	}{
+		{"code only", words(0xC0000000, 5, 0x4000001F, 0x40000000), []uint32{0xC0000000, 5, 0x4000001F, 0x40000000}, nil},
+		{"code and data", words(0x40000000, DataMarker, 1, 0xFFFFFFFF), []uint32{0x40000000}, []int32{1, -1}},
+		{"empty data", words(0x40000000, DataMarker), []uint32{0x40000000}, []int32{}},
+	}
+	for _, c := range cases {
+		image, err := DecodeRawImage(c.bytes)
+		if err != nil || !reflect.DeepEqual(image.Code, c.code) || !reflect.DeepEqual(image.Data, c.data) {
+			t.Errorf("%s: got %v %v, %v, expected %v %v", c.name, image.Code, image.Data, err, c.code, c.data)
+		}
+	}
+
+	if _, err := DecodeRawImage([]byte{0x40, 0, 0, 0, 0}); !errors.Is(err, ErrCorruptImage) {
+		t.Errorf("partial word: got %v, expected %v", err, ErrCorruptImage)
+	}
+}
@@ -0,0 +1,50 @@
+package palsm_h
+
+// Command describes a mnemonic, its op code is 0x40000000 plus its index in Commands
+type Command struct {
+	Name      string
+	NumParams int
+}
+
+// WideImmediate is an op code no command uses, put in front of an operand too big for the 30 bits of a tagged int.
+// The word after it is the operand as a raw int32.
+const WideImmediate uint32 = 0x7FFFFFFE
+
+// Commands in op code order, shared by the assembler and the VM
+var Commands = []Command{
+	{"HALT", 0},
+	{"PEEK", 0},
+	{"ADD", 2},
+	{"SUB", 2},
+	{"MUL", 2},
+	{"DIV", 2},
+	{"AND", 2},
+	{"OR", 2},
+	{"PUSH", 1},
+	{"POP", 1},
+	{"MOV", 2},
+	{"EQ", 2},
+	{"NEQ", 2},
+	{"GT", 2},
+	{"LT", 2},
+	{"GTE", 2},
+	{"LTE", 2},
+	{"JMP", 1},
+	{"JMPF", 1},
+	{"CALL", 1},
+	{"RET", 0},
+	{"LOAD", 2},
+	{"STORE", 2},
+	{"MOD", 2},
+	{"BAND", 2},
+	{"BOR", 2},
+	{"BXOR", 2},
+	{"BNOT", 1},
+	{"SHL", 2},
+	{"SHR", 2},
+	{"SAR", 2},
+	{"OUT", 1},
+	{"OUTC", 1},
+	{"IN", 1},
+	{"INC", 1},
+}
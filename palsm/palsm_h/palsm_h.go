@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 func ReadFile(filePath string) string {
@@ -40,26 +41,31 @@ func ReadFile(filePath string) string {
 	return data
 }
 
-func WriteBinaryFile(filePath string, instructions []uint32) {
-	fileName := filePath[0 : len(filePath)-len(filepath.Ext(filePath))]
+// DataMarker separates the program from the .data section in a legacy raw .bin file. It is an op code no command uses.
+const DataMarker uint32 = 0x7FFFFFFF
 
-	file, err := os.Create(fileName + ".bin")
-
-	if err != nil {
-		panic(err)
-	}
-
-	for _, inst := range instructions {
-		buff := make([]byte, 4)
-		for i := 3; i >= 0; i-- {
-			buff[3-i] = byte((inst >> (8 * i)) & 0xFF)
-		}
-		numOfBytes, err := file.Write(buff)
-		if numOfBytes != 4 || err != nil {
-			fmt.Println("ERROR: Something went wrong when writing to", fileName+".bin")
-			os.Exit(1)
+// Split the words of a legacy raw .bin file back into the program and its data
+func SplitImage(image []uint32) ([]uint32, []int32) {
+	for i, word := range image {
+		if word == DataMarker {
+			data := make([]int32, 0, len(image)-i-1)
+			for _, dataWord := range image[i+1:] {
+				data = append(data, int32(dataWord))
+			}
+			return image[:i], data
 		}
 	}
+	return image, nil
+}
+
+// StringList is a flag.Value that can be given more than once, collecting every value, used for -I
+type StringList []string
+
+func (list *StringList) String() string {
+	return strings.Join(*list, ",")
+}
 
-	file.Close()
+func (list *StringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
 }